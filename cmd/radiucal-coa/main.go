@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc3576"
+	"voidedtech.com/radiucal/internal/core"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+func send(config, nas, via string, port int, disconnect bool, selectors server.DynamicSelectors, timeout time.Duration) error {
+	conf, err := server.LoadConfiguration(config)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(nas)
+	if ip == nil {
+		return fmt.Errorf("invalid NAS address: %s", nas)
+	}
+	to := net.JoinHostPort(nas, strconv.Itoa(port))
+	if len(via) > 0 {
+		to = via
+	}
+	host, _, err := net.SplitHostPort(to)
+	if err != nil {
+		return err
+	}
+	dest, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return err
+	}
+	secret, err := server.LookupSecret(conf.Dir, dest.IP)
+	if err != nil {
+		return err
+	}
+	p, err := server.NewDynamicRequest(disconnect, secret, ip, selectors)
+	if err != nil {
+		return err
+	}
+	resp, err := server.ExchangeDynamic(p, to, timeout)
+	if err != nil {
+		return err
+	}
+	switch resp.Code {
+	case radius.CodeCoAACK, radius.CodeDisconnectACK:
+		core.WriteInfo("acknowledged", resp.Code.String())
+		return nil
+	}
+	return fmt.Errorf("request was not acknowledged: %s (%s)", resp.Code.String(), rfc3576.ErrorCause_Get(resp).String())
+}
+
+func main() {
+	config := flag.String("config", "/etc/radiucal/radiucal.conf", "Configuration file (for the secrets/clients directory)")
+	nas := flag.String("nas", "", "NAS address")
+	port := flag.Int("port", server.DynamicPort, "NAS dynamic authorization port")
+	via := flag.String("via", "", "send through a relay (host:port) instead of directly to the NAS")
+	disconnect := flag.Bool("disconnect", false, "send a Disconnect-Request instead of a CoA-Request")
+	user := flag.String("user", "", "User-Name of the session")
+	mac := flag.String("mac", "", "Calling-Station-Id of the session")
+	session := flag.String("session", "", "Acct-Session-Id of the session")
+	vlan := flag.Int("vlan", 0, "VLAN to change the session to (CoA only)")
+	timeout := flag.Int("timeout", 5, "seconds to wait for the NAS to respond")
+	flag.Parse()
+	selectors := server.DynamicSelectors{
+		UserName:       *user,
+		CallingStation: *mac,
+		SessionID:      *session,
+		VLAN:           *vlan,
+	}
+	if err := send(*config, *nas, *via, *port, *disconnect, selectors, time.Duration(*timeout)*time.Second); err != nil {
+		core.ExitNow("dynamic authorization failed", err)
+	}
+}
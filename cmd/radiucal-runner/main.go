@@ -1,91 +1,173 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
-	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"syscall"
 	"time"
 
-	yaml "gopkg.in/yaml.v2"
 	"layeh.com/radius"
 	"voidedtech.com/radiucal/internal/core"
 	"voidedtech.com/radiucal/internal/server"
 	"voidedtech.com/radiucal/internal/server/plugins"
 )
 
-var (
-	proxy         *net.UDPConn
-	serverAddress *net.UDPAddr
-	clients                   = make(map[string]*connection)
-	clientLock    *sync.Mutex = new(sync.Mutex)
+type (
+	// listener is a bound port with the state for answering its clients
+	listener struct {
+		conn    *net.UDPConn
+		status  *server.StatusServer
+		cache   *server.ResponseCache
+		workers *server.WorkerPool
+	}
 )
 
-type (
-	connection struct {
-		client *net.UDPAddr
-		server *net.UDPConn
+var (
+	auth      *listener
+	acct      *listener
+	radsec    net.Listener
+	fallback  *server.MABFallback
+	upstreams *server.UpstreamPool
+	clients   *server.ConnectionTable
+	done      = make(chan struct{})
+	// connect gets the client's connection to the upstream
+	connect = func(cli *net.UDPAddr, up *server.Upstream) (*server.Connection, bool, error) {
+		return clients.Get(cli, up)
 	}
 )
 
-func newConnection(srv, cli *net.UDPAddr) *connection {
-	conn := new(connection)
-	conn.client = cli
-	serverUDP, err := net.DialUDP("udp", nil, srv)
-	if err != nil {
-		core.WriteError("dial udp", err)
-		return nil
+// stopping indicates the runner is shutting down
+func stopping() bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
 	}
-	conn.server = serverUDP
-	return conn
 }
 
-func setup(hostport string, port int) error {
-	proxyAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+func setup(port int) (*listener, error) {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	proxyUDP, err := net.ListenUDP("udp", proxyAddr)
+	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	proxy = proxyUDP
-	serverAddr, err := net.ResolveUDPAddr("udp", hostport)
-	if err != nil {
-		return err
-	}
-	serverAddress = serverAddr
-	return nil
+	return &listener{conn: conn}, nil
 }
 
-func runConnection(ctx *server.Context, conn *connection) {
+func runConnection(ctx *server.Context, conn *server.Connection) {
 	var buffer [radius.MaxPacketLength]byte
 	for {
-		n, err := conn.server.Read(buffer[0:])
+		n, err := conn.Server.Read(buffer[0:])
 		if err != nil {
+			if conn.Closed() {
+				if ctx.Debug {
+					core.WriteDebug("connection closed", conn.Client.String())
+				}
+				return
+			}
 			core.WriteError("unable to read buffer", err)
 			continue
 		}
+		conn.Touch()
 		buffered := []byte(buffer[0:n])
-		if !checkAuth("post", server.PostAuthorize, ctx, buffered, conn.client, conn.client) {
+		postauth := server.PostAuthorize
+		if request, ok := upstreams.Responded(conn.Upstream, conn.Client, buffered); ok {
+			postauth = server.PostAuthorizeReply(request)
+		}
+		checked, authed := checkAuth("post", postauth, ctx, buffered, conn.Client, conn.Client)
+		if !authed {
+			auth.cache.Drop(conn.Client, buffered)
 			continue
 		}
-		if _, err := proxy.WriteToUDP(buffer[0:n], conn.client); err != nil {
-			core.WriteError("error relaying", err)
+		auth.reply(checked, conn.Client)
+	}
+}
+
+// reply writes to a client, remembering the reply for retransmissions
+func (l *listener) reply(b []byte, client *net.UDPAddr) {
+	if _, err := l.conn.WriteToUDP(b, client); err != nil {
+		core.WriteError("error relaying", err)
+		return
+	}
+	l.cache.Reply(client, b)
+}
+
+// retransmitted checks for (and replays the reply to) a retransmitted request
+func (l *listener) retransmitted(ctx *server.Context, b []byte, client *net.UDPAddr) (server.Retransmission, []byte) {
+	result, cached := l.cache.Request(client, b, time.Now())
+	if result == server.NotRetransmitted {
+		return result, nil
+	}
+	if ctx.Debug {
+		core.WriteDebug("retransmitted request", client.String(), result.String())
+	}
+	if result == server.ReplayRetransmission {
+		if _, err := l.conn.WriteToUDP(cached, client); err != nil {
+			core.WriteError("unable to replay reply", err)
+		}
+	}
+	return result, cached
+}
+
+func expireCache(ctx *server.Context, l *listener) {
+	for {
+		time.Sleep(server.CacheWindow)
+		expired := l.cache.Expire(time.Now())
+		if ctx.Debug && expired > 0 {
+			core.WriteDebug("expired cached requests", fmt.Sprintf("%d", expired), fmt.Sprintf("%d", l.cache.Len()))
 		}
 	}
 }
 
-func checkAuth(name string, fxn server.AuthorizePacket, ctx *server.Context, b []byte, addr, client *net.UDPAddr) bool {
-	auth := server.HandleAuth(fxn, ctx, b, addr, func(buffer []byte) {
-		proxy.WriteToUDP(buffer, client)
+func reapConnections(ctx *server.Context, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		reaped := clients.Reap(time.Now())
+		if ctx.Debug && reaped > 0 {
+			core.WriteDebug("reaped idle connections", fmt.Sprintf("%d", reaped), fmt.Sprintf("%d", clients.Len()))
+		}
+	}
+}
+
+func checkUpstreams() {
+	for {
+		time.Sleep(time.Second)
+		upstreams.Check(time.Now())
+	}
+}
+
+func probeUpstreams(ctx *server.Context, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		upstreams.Probe(ctx)
+	}
+}
+
+// answerStatus answers a Status-Server locally (false for any other request)
+func (l *listener) answerStatus(b []byte, client *net.UDPAddr) bool {
+	return l.status.Handle(b, client, func(resp []byte) {
+		if _, err := l.conn.WriteToUDP(resp, client); err != nil {
+			core.WriteError("unable to answer status", err)
+		}
 	})
-	if !auth {
+}
+
+func checkAuth(name string, fxn server.AuthorizePacket, ctx *server.Context, b []byte, addr, client *net.UDPAddr) ([]byte, bool) {
+	checked, result := server.HandleAuth(fxn, ctx, b, addr, func(buffer []byte) {
+		auth.reply(buffer, client)
+	})
+	if !result {
 		core.WriteDebug("client failed auth check", name)
 	}
-	return auth
+	return checked, result
 }
 
 func runProxy(ctx *server.Context) {
@@ -97,85 +179,237 @@ func runProxy(ctx *server.Context) {
 		core.WriteInfo("=============WARNING==================")
 		ctx.DebugDump()
 	}
+	auth.serve(ctx, "read from udp", proxyPacket)
+}
+
+func proxyPacket(ctx *server.Context, b []byte, cliaddr *net.UDPAddr) {
+	if auth.answerStatus(b, cliaddr) {
+		return
+	}
+	retransmit, relayed := auth.retransmitted(ctx, b, cliaddr)
+	if retransmit == server.ReplayRetransmission || retransmit == server.DropRetransmission {
+		return
+	}
+	// requests not relayed are dropped, so their retransmissions are not relayed without the plugins either
+	if fallback.Handle(b, cliaddr, func(resp []byte) {
+		auth.reply(resp, cliaddr)
+	}) {
+		auth.cache.Drop(cliaddr, b)
+		return
+	}
+	upstream, routed := server.RouteRequest(ctx, upstreams, cliaddr, b, func(resp []byte) {
+		auth.reply(resp, cliaddr)
+	})
+	if upstream == nil {
+		auth.cache.Drop(cliaddr, b)
+		return
+	}
+	conn, created, err := connect(cliaddr, upstream)
+	if err != nil {
+		core.WriteError("dial udp", err)
+		auth.cache.Drop(cliaddr, b)
+		return
+	}
+	if created {
+		go runConnection(ctx, conn)
+	}
+	// a retransmission still awaiting a reply is relayed as the plugins rewrote it, anything else is pre-authorized
+	relay := retransmit == server.RelayRetransmission && relayed != nil
+	if relay {
+		routed = relayed
+	} else {
+		checked, authed := checkAuth("pre", server.PreAuthorize, ctx, routed, cliaddr, conn.Client)
+		if !authed {
+			auth.cache.Drop(cliaddr, b)
+			return
+		}
+		routed = checked
+		auth.cache.Relayed(cliaddr, routed)
+	}
+	if _, err := conn.Server.Write(routed); err != nil {
+		core.WriteError("unable to write to the server", err)
+		auth.cache.Drop(cliaddr, b)
+		return
+	}
+	if !relay {
+		upstreams.Sent(conn.Upstream, cliaddr, routed)
+	}
+}
+
+func account(ctx *server.Context) {
+	acct.serve(ctx, "accounting udp error", accountPacket)
+}
+
+func accountPacket(ctx *server.Context, b []byte, cliaddr *net.UDPAddr) {
+	if acct.answerStatus(b, cliaddr) {
+		return
+	}
+	// accounting is answered (or dropped) only once, even when forwarding is still in progress
+	if retransmit, _ := acct.retransmitted(ctx, b, cliaddr); retransmit != server.NotRetransmitted {
+		return
+	}
+	if !server.HandleAccounting(ctx, b, cliaddr, func(resp []byte) {
+		acct.reply(resp, cliaddr)
+	}) {
+		acct.cache.Drop(cliaddr, b)
+	}
+}
+
+// serve reads packets and hands them to the workers, packets are dropped while the workers are saturated
+func (l *listener) serve(ctx *server.Context, readErr string, handle func(*server.Context, []byte, *net.UDPAddr)) {
 	var buffer [radius.MaxPacketLength]byte
 	for {
-		n, cliaddr, err := proxy.ReadFromUDP(buffer[0:])
+		n, cliaddr, err := l.conn.ReadFromUDP(buffer[0:])
+		if stopping() {
+			return
+		}
 		if err != nil {
-			core.WriteError("read from udp", err)
+			core.WriteError(readErr, err)
 			continue
 		}
-		addr := cliaddr.String()
-		clientLock.Lock()
-		conn, found := clients[addr]
-		if !found {
-			conn = newConnection(serverAddress, cliaddr)
-			if conn == nil {
-				clientLock.Unlock()
-				continue
-			}
-			clients[addr] = conn
-			clientLock.Unlock()
-			go runConnection(ctx, conn)
-		} else {
-			clientLock.Unlock()
+		buffered := append([]byte{}, buffer[0:n]...)
+		if !l.workers.Submit(cliaddr, func() {
+			handle(ctx, buffered, cliaddr)
+		}) && ctx.Debug {
+			core.WriteDebug("workers saturated, packet dropped", cliaddr.String())
 		}
-		buffered := []byte(buffer[0:n])
-		if !checkAuth("pre", server.PreAuthorize, ctx, buffered, cliaddr, conn.client) {
-			continue
+	}
+}
+
+func setupRadSec(ctx *server.Context, conf *server.Configuration) error {
+	config, err := server.NewRadSecTLS(conf)
+	if err != nil {
+		return err
+	}
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", conf.RadSec.Bind), config)
+	if err != nil {
+		return err
+	}
+	radsec = listener
+	core.WriteInfo("radsec listening", fmt.Sprintf("%d", conf.RadSec.Bind))
+	relay := server.NewRadSec(ctx, upstreams, auth.status, listener, time.Duration(conf.Connections.Idle)*time.Second)
+	go func() {
+		if err := relay.Serve(); err != nil && !stopping() {
+			core.WriteError("radsec listener failed", err)
+		}
+	}()
+	return nil
+}
+
+func setupDynamic(ctx *server.Context, conf *server.Configuration) error {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", conf.CoA.Bind))
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	core.WriteInfo("coa listening", fmt.Sprintf("%d", conf.CoA.Bind))
+	relay := server.NewDynamicRelay(ctx, conn, conf.CoA.Port)
+	go func() {
+		if err := relay.Serve(); err != nil {
+			core.WriteError("coa relay failed", err)
+		}
+	}()
+	return nil
+}
+
+// shutdown stops reading requests, waits (up to the drain) for those in progress, and flushes the plugins
+func shutdown(ctx *server.Context, conf *server.Configuration, instance string) {
+	drain := time.Duration(conf.Internals.Drain) * time.Second
+	end := time.Now().Add(drain)
+	close(done)
+	var listeners []*listener
+	for _, l := range []*listener{auth, acct} {
+		if l != nil {
+			l.conn.SetReadDeadline(time.Now())
+			listeners = append(listeners, l)
 		}
-		if _, err := conn.server.Write(buffer[0:n]); err != nil {
-			core.WriteError("unable to write to the server", err)
+	}
+	if radsec != nil {
+		radsec.Close()
+	}
+	processed := make(chan bool)
+	go func() {
+		for _, l := range listeners {
+			l.workers.Close()
 		}
+		close(processed)
+	}()
+	select {
+	case <-processed:
+	case <-time.After(drain):
+		core.WriteWarn("shutting down with requests still being processed")
+	}
+	if outstanding := server.Drain(ctx, upstreams, time.Until(end)); outstanding > 0 {
+		core.WriteWarn("shutting down with outstanding requests", fmt.Sprintf("%d", outstanding))
 	}
+	ctx.Teardown()
+	server.WritePluginMessages(conf.Log, instance)
 }
 
-func account(ctx *server.Context) {
-	var buffer [radius.MaxPacketLength]byte
-	for {
-		n, cliaddr, err := proxy.ReadFromUDP(buffer[0:])
-		if err != nil {
-			core.WriteError("accounting udp error", err)
-			continue
+func serveMetrics(bind, path string) {
+	core.WriteInfo("metrics listening", bind, path)
+	mux := http.NewServeMux()
+	mux.Handle(path, server.DefaultMetrics())
+	if err := http.ListenAndServe(bind, mux); err != nil {
+		core.WriteError("metrics listener failed", err)
+	}
+}
+
+// reload applies the configuration (except for settings requiring a restart), giving the applied configuration
+func reload(ctx *server.Context, file string, running *server.Configuration) *server.Configuration {
+	conf, err := server.LoadConfiguration(file)
+	if err != nil {
+		core.WriteError("unable to reload config", err)
+		return running
+	}
+	if ctx.Debug {
+		conf.Dump()
+	}
+	for _, setting := range running.RequiresRestart(conf) {
+		core.WriteWarn("configuration change requires a restart", setting)
+	}
+	if err := ctx.Reload(conf); err != nil {
+		core.WriteError("unable to reload", err)
+		return running
+	}
+	if fallback != nil {
+		if err := fallback.Load(); err != nil {
+			core.WriteError("unable to reload MAB fallback", err)
 		}
-		ctx.Account(server.NewClientPacket(buffer[0:n], cliaddr))
 	}
+	if ctx.Debug {
+		ctx.DebugDump()
+	}
+	core.WriteInfo("reloaded")
+	return conf
 }
 
 func main() {
 	p := server.Flags()
 	core.ConfigureLogging(p.Debug, p.Instance)
-	b, err := ioutil.ReadFile(p.Config)
+	conf, err := server.LoadConfiguration(p.Config)
 	if err != nil {
 		core.Fatal("unable to load config", err)
 	}
-	conf := &server.Configuration{}
-	if err := yaml.Unmarshal(b, conf); err != nil {
-		core.Fatal("unable to parse config", err)
-	}
-	conf.Defaults(b)
 	if p.Debug {
 		conf.Dump()
 	}
-	to := 1814
-	if !conf.Accounting {
-		if conf.To > 0 {
-			to = conf.To
-		}
-	}
-	addr := fmt.Sprintf("%s:%d", conf.Host, to)
-	if err := setup(addr, conf.Bind); err != nil {
+	bound, err := setup(conf.Bind)
+	if err != nil {
 		core.Fatal("proxy setup", err)
 	}
 
 	ctx := &server.Context{Debug: p.Debug}
 	ctx.FromConfig(conf.Dir, conf)
 	pCtx := server.NewPluginContext(conf)
-	for _, p := range conf.Plugins {
-		core.WriteInfo("loading plugin", p)
-		obj, err := plugins.LoadPlugin(p, pCtx)
-		if err != nil {
-			core.Fatal(fmt.Sprintf("unable to load plugin: %s", p), err)
-		}
+	mods, err := plugins.LoadPlugins(conf.Plugins, pCtx)
+	if err != nil {
+		core.Fatal("unable to load plugins", err)
+	}
+	for idx, obj := range mods {
 		if i, ok := obj.(server.Accounting); ok {
 			ctx.AddAccounting(i)
 		}
@@ -188,7 +422,10 @@ func main() {
 		if i, ok := obj.(server.PostAuth); ok {
 			ctx.AddPostAuth(i)
 		}
-		ctx.AddModule(obj)
+		if i, ok := obj.(server.Dynamic); ok {
+			ctx.AddDynamic(i)
+		}
+		ctx.AddPlugin(conf.Plugins[idx], obj)
 	}
 
 	if !conf.Internals.NoLogs {
@@ -206,7 +443,7 @@ func main() {
 	interrupt := make(chan bool)
 	if !conf.Internals.NoInterrupt {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		go func() {
 			for range c {
 				if ctx.Debug {
@@ -216,6 +453,18 @@ func main() {
 			}
 		}()
 	}
+	if len(conf.Metrics.Bind) > 0 {
+		go serveMetrics(conf.Metrics.Bind, conf.Metrics.Path)
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		running := conf
+		for range hangup {
+			core.WriteInfo("reloading...")
+			running = reload(ctx, p.Config, running)
+		}
+	}()
 	lifecycle := make(chan bool)
 	check := time.Duration(conf.Internals.SpanCheck) * time.Hour
 	end := time.Now().Add(time.Duration(conf.Internals.Lifespan) * time.Hour)
@@ -237,11 +486,80 @@ func main() {
 			}
 		}
 	}()
+	if conf.CoA.Bind > 0 {
+		if err := setupDynamic(ctx, conf); err != nil {
+			core.Fatal("coa setup", err)
+		}
+	}
 	if conf.Accounting {
 		core.WriteInfo("accounting mode")
-		go account(ctx)
+		acct = bound
 	} else {
 		core.WriteInfo("proxy mode")
+		auth = bound
+		if conf.AccountingBind > 0 {
+			core.WriteInfo("accounting listening", fmt.Sprintf("%d", conf.AccountingBind))
+			acct, err = setup(conf.AccountingBind)
+			if err != nil {
+				core.Fatal("accounting setup", err)
+			}
+		}
+	}
+	// authentication and accounting share the context (and plugins) when both are served
+	for name, l := range map[string]*listener{"auth": auth, "accounting": acct} {
+		if l == nil {
+			continue
+		}
+		if conf.Cache {
+			l.cache = server.NewResponseCache(server.CacheWindow)
+			go expireCache(ctx, l)
+		}
+		l.workers = server.NewWorkerPool(name, conf.Workers.Count, conf.Workers.Queue)
+		queued := l.workers.Queued
+		if err := server.DefaultMetrics().NewGaugeFunc(fmt.Sprintf("radiucal_%s_queued", name), "Packets waiting for a worker", func() float64 {
+			return float64(queued())
+		}); err != nil {
+			core.Fatal("unable to register metrics", err)
+		}
+	}
+	if acct != nil {
+		acct.status = server.NewStatusServer(ctx, true, nil)
+		go account(ctx)
+	}
+	if auth != nil {
+		pool, err := server.NewUpstreamPool(conf)
+		if err != nil {
+			core.Fatal("upstream setup", err)
+		}
+		upstreams = pool
+		clients = server.NewConnectionTable(time.Duration(conf.Connections.Idle)*time.Second, conf.Connections.Max)
+		if err := server.DefaultMetrics().NewGaugeFunc("radiucal_connections", "Upstream connections held for clients", func() float64 {
+			return float64(clients.Len())
+		}); err != nil {
+			core.Fatal("unable to register metrics", err)
+		}
+		go reapConnections(ctx, time.Duration(conf.Connections.Reap)*time.Second)
+		go checkUpstreams()
+		var report *server.UpstreamPool
+		if conf.Status.Upstreams {
+			report = upstreams
+		}
+		auth.status = server.NewStatusServer(ctx, false, report)
+		if conf.Fallback.MAB {
+			mab, err := server.NewMABFallback(ctx, upstreams, conf.FallbackManifest(), conf.Fallback.Users)
+			if err != nil {
+				core.Fatal("MAB fallback setup", err)
+			}
+			fallback = mab
+		}
+		if conf.Status.Probe > 0 {
+			go probeUpstreams(ctx, time.Duration(conf.Status.Probe)*time.Second)
+		}
+		if conf.RadSec.Bind > 0 {
+			if err := setupRadSec(ctx, conf); err != nil {
+				core.Fatal("radsec setup", err)
+			}
+		}
 		go runProxy(ctx)
 	}
 	select {
@@ -250,6 +568,6 @@ func main() {
 	case <-lifecycle:
 		core.WriteInfo("lifecyle...")
 	}
-	server.WritePluginMessages(conf.Log, p.Instance)
+	shutdown(ctx, conf, p.Instance)
 	os.Exit(0)
 }
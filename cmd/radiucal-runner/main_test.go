@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+type rejectModule struct {
+	reject bool
+}
+
+func (m *rejectModule) Name() string {
+	return "reject"
+}
+
+func (m *rejectModule) Setup(ctx *server.PluginContext) error {
+	return nil
+}
+
+func (m *rejectModule) Pre(p *server.ClientPacket) bool {
+	return !m.reject
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("unable to listen", err)
+	}
+	return conn
+}
+
+func newRequest(t *testing.T, identifier byte) []byte {
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	p.Identifier = identifier
+	rfc2865.UserName_SetString(p, "user")
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, err := server.EncodePacket(p)
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	return b
+}
+
+// received reads a packet (nil when nothing arrives in time)
+func received(conn *net.UDPConn) []byte {
+	var buffer [radius.MaxPacketLength]byte
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, _, err := conn.ReadFromUDP(buffer[0:])
+	if err != nil {
+		return nil
+	}
+	return buffer[0:n]
+}
+
+func TestProxyRetransmissions(t *testing.T) {
+	upstream := listenUDP(t)
+	defer upstream.Close()
+	client := listenUDP(t)
+	defer client.Close()
+	cliaddr := client.LocalAddr().(*net.UDPAddr)
+	conf := &server.Configuration{}
+	conf.Upstreams.Servers = []string{upstream.LocalAddr().String()}
+	conf.Defaults([]byte{})
+	ctx := &server.Context{}
+	ctx.FromConfig("../../tests", conf)
+	module := &rejectModule{reject: true}
+	ctx.AddPreAuth(module)
+	auth = &listener{conn: listenUDP(t), status: server.NewStatusServer(ctx, false, nil), cache: server.NewResponseCache(time.Minute)}
+	defer auth.conn.Close()
+	pool, err := server.NewUpstreamPool(conf)
+	if err != nil {
+		t.Fatal("unable to create upstreams", err)
+	}
+	upstreams = pool
+	clients = server.NewConnectionTable(time.Minute, 10)
+	defer clients.Close()
+	connect = func(cli *net.UDPAddr, up *server.Upstream) (*server.Connection, bool, error) {
+		return nil, false, fmt.Errorf("dial failed")
+	}
+	b := newRequest(t, 1)
+	proxyPacket(ctx, b, cliaddr)
+	connect = func(cli *net.UDPAddr, up *server.Upstream) (*server.Connection, bool, error) {
+		return clients.Get(cli, up)
+	}
+	proxyPacket(ctx, b, cliaddr)
+	if received(upstream) != nil {
+		t.Error("retransmission of a request that failed to dial should not be relayed")
+	}
+	// the first copy is still being handled (nothing relayed yet)
+	b = newRequest(t, 2)
+	auth.cache.Request(cliaddr, b, time.Now())
+	proxyPacket(ctx, b, cliaddr)
+	if received(upstream) != nil {
+		t.Error("retransmission should be pre-authorized")
+	}
+	if resp := received(client); resp == nil || radius.Code(resp[0]) != radius.CodeAccessReject {
+		t.Error("retransmission should be rejected")
+	}
+	module.reject = false
+	b = newRequest(t, 3)
+	proxyPacket(ctx, b, cliaddr)
+	relayed := received(upstream)
+	if relayed == nil {
+		t.Fatal("request should be relayed")
+	}
+	proxyPacket(ctx, b, cliaddr)
+	if again := received(upstream); string(again) != string(relayed) {
+		t.Error("retransmission should be relayed as before")
+	}
+}
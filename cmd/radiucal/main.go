@@ -2,9 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
-	"os/exec"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"voidedtech.com/radiucal/internal/core"
 	"voidedtech.com/radiucal/internal/server"
@@ -12,34 +13,40 @@ import (
 
 func main() {
 	flags := server.Flags()
-	i := fmt.Sprintf("instance: %s", flags.Instance)
-	args := flags.Args()
-	if flags.Debug {
-		core.WriteDebug(fmt.Sprintf("flags: %v", args))
+	core.ConfigureLogging(flags.Debug, flags.Instance)
+	conf, err := server.LoadSupervisorConfiguration(flags.Config)
+	if err != nil {
+		core.Fatal("unable to load config", err)
+	}
+	if len(conf.Instances) == 0 {
+		// a runner configuration, supervise just that instance
+		conf.Instances = []server.SupervisedInstance{{Name: flags.Instance, Config: flags.Config, Debug: flags.Debug}}
 	}
-	last := time.Now()
-	errors := 0
-	for {
-		core.WriteInfo("starting " + i)
-		cmd := exec.Command("radiucal-runner", args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			core.WriteWarn(fmt.Sprintf("radiucal runner ended %s (%v)", i, err))
+	if flags.Debug {
+		for _, i := range conf.Instances {
+			core.WriteDebug(fmt.Sprintf("instance: %s %v", i.Name, server.ProcessFlags{Config: i.Config, Debug: i.Debug}.Args()))
 		}
-		now := time.Now()
-		sleep := 10 * time.Millisecond
-		if now.Sub(last).Seconds() < 30 {
-			if errors > 3 {
-				core.WriteWarn("cool down for restart")
-				sleep = 5 * time.Second
-			} else {
-				errors++
+	}
+	supervisor := server.NewSupervisor(conf, server.RunnerCommand)
+	if len(conf.Status) > 0 {
+		go func() {
+			core.WriteInfo("status listening", conf.Status)
+			if err := http.ListenAndServe(conf.Status, supervisor); err != nil {
+				core.WriteError("status listener failed", err)
 			}
-		} else {
-			errors = 0
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	supervisor.Start()
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			core.WriteInfo("reloading instances")
+			supervisor.Signal(sig)
+			continue
 		}
-		time.Sleep(sleep)
-		last = now
+		core.WriteInfo("stopping instances")
+		supervisor.Stop()
+		return
 	}
 }
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"layeh.com/radius"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+const (
+	// maxForwarding is the most accounting requests forwarded at once (others are dropped, for the client to retry)
+	maxForwarding = 256
+	// forwarding outcomes (when not forwarded)
+	duplicateForward = "duplicate"
+	saturatedForward = "saturated"
+)
+
+var (
+	acctMetric = newCounter("radiucal_accounting_total", "Accounting request outcomes", "result")
+)
+
+func (ctx *Context) accountingForward() (string, time.Duration) {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+	return ctx.forward, ctx.timeout
+}
+
+// HandleAccounting accounts a request and, once accepted (and forwarded when an upstream accounting server is
+// configured), answers the client with an Accounting-Response
+func HandleAccounting(ctx *Context, b []byte, addr *net.UDPAddr, write writeBack) bool {
+	forward, timeout := ctx.accountingForward()
+	key := ""
+	if len(forward) > 0 && len(b) >= 20 {
+		key = fmt.Sprintf("%s/%d/%x", addr, b[1], b[4:20])
+		if reason := ctx.beginForward(key); len(reason) > 0 {
+			acctMetric.Inc(reason)
+			// retransmissions are answered once the request being forwarded is
+			return reason == duplicateForward
+		}
+	}
+	packet := NewClientPacket(b, addr)
+	code := ctx.Account(packet)
+	if code != successCode {
+		ctx.endForward(key)
+		acctMetric.Inc(code.String())
+		return false
+	}
+	if len(forward) == 0 {
+		respondAccounting(ctx, packet, write)
+		return true
+	}
+	go func() {
+		defer ctx.endForward(key)
+		if err := forwardAccounting(packet, ctx.sharedSecret(), forward, timeout); err != nil {
+			core.WriteError("unable to forward accounting", err)
+			acctMetric.Inc("forward")
+			return
+		}
+		respondAccounting(ctx, packet, write)
+	}()
+	return true
+}
+
+// beginForward reserves the forwarding of a request, giving the reason when it is not forwarded (already being
+// forwarded or too many requests are)
+func (ctx *Context) beginForward(key string) string {
+	ctx.forwardLock.Lock()
+	defer ctx.forwardLock.Unlock()
+	if ctx.forwarding[key] {
+		return duplicateForward
+	}
+	if len(ctx.forwarding) >= maxForwarding {
+		return saturatedForward
+	}
+	if ctx.forwarding == nil {
+		ctx.forwarding = make(map[string]bool)
+	}
+	ctx.forwarding[key] = true
+	return ""
+}
+
+func (ctx *Context) endForward(key string) {
+	if len(key) == 0 {
+		return
+	}
+	ctx.forwardLock.Lock()
+	defer ctx.forwardLock.Unlock()
+	delete(ctx.forwarding, key)
+}
+
+// forwards is the number of accounting requests being forwarded
+func (ctx *Context) forwards() int {
+	ctx.forwardLock.Lock()
+	defer ctx.forwardLock.Unlock()
+	return len(ctx.forwarding)
+}
+
+func respondAccounting(ctx *Context, packet *ClientPacket, write writeBack) {
+	resp, err := EncodePacket(packet.Packet.Response(radius.CodeAccountingResponse))
+	if err != nil {
+		core.WriteError("unable to encode accounting response", err)
+		return
+	}
+	if ctx.Debug {
+		core.WriteDebug("accounting response", packet.ClientAddr.String())
+	}
+	acctMetric.Inc(successCode.String())
+	if write != nil {
+		write(resp)
+	}
+}
+
+// forwardAccounting relays an (accepted) accounting request to the upstream accounting server
+func forwardAccounting(packet *ClientPacket, secret []byte, addr string, timeout time.Duration) error {
+	b, err := ResignRequest(packet.Buffer, packet.Packet.Secret, secret)
+	if err != nil {
+		return err
+	}
+	req, err := radius.Parse(b, secret)
+	if err != nil {
+		return err
+	}
+	c, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := radius.Exchange(c, req, addr)
+	if err != nil {
+		return err
+	}
+	if resp.Code != radius.CodeAccountingResponse {
+		return fmt.Errorf("unexpected upstream response: %s", resp.Code)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func getAccounting(t *testing.T, secret []byte) []byte {
+	p := radius.New(radius.CodeAccountingRequest, secret)
+	rfc2865.UserName_SetString(p, "user")
+	b, err := p.Encode()
+	if err != nil {
+		t.Fatal("unable to encode")
+	}
+	return b
+}
+
+func TestClientSecret(t *testing.T) {
+	ctx := &Context{secret: []byte("secret")}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 10, 1, 100)}
+	if string(ctx.clientSecret(nil)) != "secret" {
+		t.Error("shared secret without mappings")
+	}
+	ctx.secrets = testMappings(t, map[string]string{"10.0.0.0/8": "short", "10.10.0.0/16": "long"})
+	if ctx.clientSecret(nil) != nil {
+		t.Error("no address")
+	}
+	if string(ctx.clientSecret(addr)) != "long" {
+		t.Error("longest mapping should match")
+	}
+	if ctx.clientSecret(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 1)}) != nil {
+		t.Error("no matching mapping")
+	}
+	ctx.secrets = testMappings(t, map[string]string{"10.0.0.0/8": "short", "0.0.0.0/0": "all"})
+	if string(ctx.clientSecret(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 1)})) != "all" {
+		t.Error("all mapping")
+	}
+}
+
+func TestAccountAuthenticator(t *testing.T) {
+	ctx := &Context{secret: []byte("secret")}
+	m := &MockModule{}
+	ctx.AddAccounting(m)
+	if ctx.Account(NewClientPacket(getAccounting(t, []byte("other")), nil)) != badAuthCode || m.acct != 0 {
+		t.Error("invalid authenticator")
+	}
+	if ctx.Account(NewClientPacket(getAccounting(t, ctx.secret), nil)) != successCode || m.acct != 1 {
+		t.Error("valid authenticator")
+	}
+	m.fail = true
+	if ctx.Account(NewClientPacket(getAccounting(t, ctx.secret), nil)) != acctCode || m.acct != 2 {
+		t.Error("module did not accept")
+	}
+}
+
+func TestHandleAccounting(t *testing.T) {
+	ctx := &Context{secret: []byte("secret")}
+	m := &MockModule{}
+	ctx.AddAccounting(m)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	var written [][]byte
+	write := func(b []byte) {
+		written = append(written, b)
+	}
+	b := getAccounting(t, ctx.secret)
+	if !HandleAccounting(ctx, b, addr, write) || len(written) != 1 {
+		t.Fatal("no accounting response")
+	}
+	if radius.Code(written[0][0]) != radius.CodeAccountingResponse || !radius.IsAuthenticResponse(written[0], b, ctx.secret) {
+		t.Error("invalid accounting response")
+	}
+	if HandleAccounting(ctx, getAccounting(t, []byte("other")), addr, write) || len(written) != 1 {
+		t.Error("invalid authenticator should be dropped")
+	}
+	m.fail = true
+	if HandleAccounting(ctx, b, addr, write) || len(written) != 1 {
+		t.Error("rejected record should not be answered")
+	}
+}
+
+func TestForwardAccountingBounded(t *testing.T) {
+	upstream, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer upstream.Close()
+	received := make(chan bool, 10)
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		for {
+			if _, _, err := upstream.ReadFromUDP(buffer[0:]); err != nil {
+				return
+			}
+			received <- true
+		}
+	}()
+	ctx := &Context{secret: []byte("secret")}
+	m := &MockModule{}
+	ctx.AddAccounting(m)
+	ctx.forward = upstream.LocalAddr().String()
+	ctx.timeout = 200 * time.Millisecond
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	write := func([]byte) {}
+	b := getAccounting(t, ctx.secret)
+	for i := 0; i < 3; i++ {
+		if !HandleAccounting(ctx, b, addr, write) {
+			t.Error("retransmissions should wait for the forwarded request")
+		}
+	}
+	if m.acct != 1 || ctx.forwards() != 1 {
+		t.Error("retransmissions should not be forwarded again", m.acct, ctx.forwards())
+	}
+	<-received
+	if Drain(ctx, nil, time.Second) != 0 {
+		t.Error("forwarding should time out")
+	}
+	if len(received) != 0 {
+		t.Error("only one request should be forwarded")
+	}
+	for i := 0; i < maxForwarding; i++ {
+		ctx.beginForward(fmt.Sprintf("test/%d", i))
+	}
+	if HandleAccounting(ctx, getAccounting(t, ctx.secret), addr, write) || m.acct != 1 {
+		t.Error("should drop while saturated")
+	}
+}
+
+func TestSharedContext(t *testing.T) {
+	ctx, p := getPacket(t)
+	m := &MockModule{}
+	ctx.AddPreAuth(m)
+	ctx.AddAccounting(m)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	write := func(b []byte) {}
+	if _, authed := HandleAuth(PreAuthorize, ctx, p.Buffer, addr, write); !authed {
+		t.Error("request should be authorized")
+	}
+	if !HandleAccounting(ctx, getAccounting(t, ctx.secret), addr, write) {
+		t.Error("record should be accepted")
+	}
+	if m.pre != 1 || m.acct != 1 {
+		t.Error("module should see authentication and accounting", m.pre, m.acct)
+	}
+}
+
+func TestForwardAccounting(t *testing.T) {
+	upstreamSecret := []byte("upstream")
+	upstream, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer upstream.Close()
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		for {
+			n, addr, err := upstream.ReadFromUDP(buffer[0:])
+			if err != nil {
+				return
+			}
+			if !radius.IsAuthenticRequest(buffer[0:n], upstreamSecret) {
+				continue
+			}
+			req, _ := radius.Parse(buffer[0:n], upstreamSecret)
+			resp, _ := req.Response(radius.CodeAccountingResponse).Encode()
+			upstream.WriteToUDP(resp, addr)
+		}
+	}()
+	ctx := &Context{secret: upstreamSecret, secrets: testMappings(t, map[string]string{"127.0.0.0/8": "client"})}
+	ctx.forward = upstream.LocalAddr().String()
+	ctx.timeout = 5 * time.Second
+	written := make(chan []byte, 1)
+	b := getAccounting(t, []byte("client"))
+	if !HandleAccounting(ctx, b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, func(r []byte) {
+		written <- r
+	}) {
+		t.Fatal("not accounted")
+	}
+	select {
+	case r := <-written:
+		if !radius.IsAuthenticResponse(r, b, []byte("client")) {
+			t.Error("response should be signed with the client secret")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no response after forwarding")
+	}
+	p := NewClientPacket(b, nil)
+	p.Packet, _ = radius.Parse(b, []byte("client"))
+	if err := forwardAccounting(p, upstreamSecret, upstream.LocalAddr().String(), 100*time.Millisecond); err != nil {
+		t.Error("should forward", err)
+	}
+	if err := forwardAccounting(p, []byte("wrong"), upstream.LocalAddr().String(), 100*time.Millisecond); err == nil {
+		t.Error("upstream should not answer")
+	}
+}
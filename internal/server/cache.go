@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// CacheWindow is how long requests (and replies) are remembered to detect retransmissions
+	CacheWindow = 30 * time.Second
+	// NotRetransmitted is a new request
+	NotRetransmitted Retransmission = 0
+	// ReplayRetransmission is a retransmission which has a reply to replay
+	ReplayRetransmission Retransmission = 1
+	// RelayRetransmission is a retransmission still awaiting a reply
+	RelayRetransmission Retransmission = 2
+	// DropRetransmission is a retransmission of a dropped request
+	DropRetransmission Retransmission = 3
+)
+
+var (
+	duplicateMetric = newCounter("radiucal_duplicates_total", "Retransmitted requests by handling", "result")
+)
+
+type (
+	// Retransmission is how a (possibly retransmitted) request should be handled
+	Retransmission int
+
+	cacheEntry struct {
+		authenticator [16]byte
+		reply         []byte
+		relayed       []byte
+		dropped       bool
+		expires       time.Time
+	}
+
+	// ResponseCache detects retransmitted requests and keeps the replies to replay (RFC 5080)
+	ResponseCache struct {
+		lock    *sync.Mutex
+		window  time.Duration
+		entries map[string]*cacheEntry
+	}
+)
+
+// NewResponseCache creates a cache remembering requests for the window
+func NewResponseCache(window time.Duration) *ResponseCache {
+	return &ResponseCache{lock: &sync.Mutex{}, window: window, entries: make(map[string]*cacheEntry)}
+}
+
+func cacheKey(cli *net.UDPAddr, identifier byte) string {
+	return fmt.Sprintf("%s/%d", cli.String(), identifier)
+}
+
+func (r Retransmission) String() string {
+	switch r {
+	case ReplayRetransmission:
+		return "replayed"
+	case RelayRetransmission:
+		return "relayed"
+	case DropRetransmission:
+		return "dropped"
+	}
+	return "new"
+}
+
+// Request records a request from a client, reporting how a retransmission should be handled along with
+// the reply to replay (or the request, as relayed upstream, to relay again)
+func (c *ResponseCache) Request(cli *net.UDPAddr, b []byte, now time.Time) (Retransmission, []byte) {
+	if c == nil || cli == nil || len(b) < 20 {
+		return NotRetransmitted, nil
+	}
+	var auth [16]byte
+	copy(auth[:], b[4:20])
+	key := cacheKey(cli, b[1])
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.authenticator != auth || !now.Before(e.expires) {
+		c.entries[key] = &cacheEntry{authenticator: auth, expires: now.Add(c.window)}
+		return NotRetransmitted, nil
+	}
+	result, cached := RelayRetransmission, e.relayed
+	if e.reply != nil {
+		result, cached = ReplayRetransmission, e.reply
+	} else if e.dropped {
+		result, cached = DropRetransmission, nil
+	}
+	duplicateMetric.Inc(result.String())
+	return result, cached
+}
+
+func (c *ResponseCache) update(cli *net.UDPAddr, b []byte, fxn func(*cacheEntry)) {
+	if c == nil || cli == nil || len(b) < 20 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[cacheKey(cli, b[1])]; ok {
+		fxn(e)
+	}
+}
+
+// Reply stores the reply sent to a client for its (outstanding) request
+func (c *ResponseCache) Reply(cli *net.UDPAddr, b []byte) {
+	c.update(cli, b, func(e *cacheEntry) {
+		e.reply = append([]byte{}, b...)
+	})
+}
+
+// Relayed stores the client's (outstanding) request as relayed upstream (after the plugins rewrote it)
+func (c *ResponseCache) Relayed(cli *net.UDPAddr, b []byte) {
+	c.update(cli, b, func(e *cacheEntry) {
+		e.relayed = append([]byte{}, b...)
+	})
+}
+
+// Drop marks the client's (outstanding) request, for the identifier of the packet, as dropped
+func (c *ResponseCache) Drop(cli *net.UDPAddr, b []byte) {
+	c.update(cli, b, func(e *cacheEntry) {
+		e.dropped = true
+	})
+}
+
+// Expire removes requests older than the window, returning the number removed
+func (c *ResponseCache) Expire(now time.Time) int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expired := 0
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Len is the number of remembered requests
+func (c *ResponseCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
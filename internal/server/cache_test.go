@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+func TestResponseCache(t *testing.T) {
+	var none *ResponseCache
+	if r, _ := none.Request(testClient(1), make([]byte, 20), time.Now()); r != NotRetransmitted || none.Len() != 0 {
+		t.Error("disabled cache")
+	}
+	c := NewResponseCache(time.Minute)
+	now := time.Now()
+	cli := testClient(1)
+	req, _ := radius.New(radius.CodeAccessRequest, []byte("secret")).Encode()
+	if r, _ := c.Request(cli, req, now); r != NotRetransmitted {
+		t.Error("new request")
+	}
+	if r, b := c.Request(cli, req, now); r != RelayRetransmission || b != nil {
+		t.Error("awaiting a reply")
+	}
+	rewritten := append(append([]byte{}, req...), 1, 3, 'a')
+	c.Relayed(cli, rewritten)
+	if r, b := c.Request(cli, req, now); r != RelayRetransmission || !bytes.Equal(b, rewritten) {
+		t.Error("should relay the rewritten request")
+	}
+	if r, _ := c.Request(testClient(2), req, now); r != NotRetransmitted {
+		t.Error("different client")
+	}
+	p, _ := radius.Parse(req, []byte("secret"))
+	resp, _ := p.Response(radius.CodeAccessAccept).Encode()
+	c.Reply(cli, resp)
+	if r, b := c.Request(cli, req, now); r != ReplayRetransmission || !bytes.Equal(b, resp) {
+		t.Error("should replay")
+	}
+	other := append([]byte{}, req...)
+	other[4]++
+	if r, _ := c.Request(cli, other, now); r != NotRetransmitted {
+		t.Error("new authenticator is a new request")
+	}
+	c.Drop(cli, other)
+	if r, _ := c.Request(cli, other, now); r != DropRetransmission {
+		t.Error("dropped request")
+	}
+	if r, _ := c.Request(cli, other, now.Add(time.Minute)); r != NotRetransmitted {
+		t.Error("expired request")
+	}
+	if c.Len() != 2 || c.Expire(now.Add(time.Hour)) != 2 || c.Len() != 0 {
+		t.Error("should expire")
+	}
+	if r, _ := c.Request(&net.UDPAddr{}, []byte{1}, now); r != NotRetransmitted {
+		t.Error("invalid packet")
+	}
+}
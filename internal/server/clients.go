@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"voidedtech.com/radiucal/internal/core"
+)
+
+type (
+	clientMapping struct {
+		network *net.IPNet
+		secret  []byte
+		// all is the catch-all mapping (the unspecified address) matching any client, IPv4 or IPv6
+		all bool
+	}
+
+	// clientMappings are client secrets ordered by prefix length (longest first)
+	clientMappings []*clientMapping
+)
+
+// parseClientNetwork parses an address (exact match) or CIDR prefix, IPv4 or IPv6, where the unspecified address
+// (0.0.0.0 or ::) matches every client
+func parseClientNetwork(key string) (*net.IPNet, error) {
+	if strings.Contains(key, "/") {
+		_, network, err := net.ParseCIDR(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix: %s", key)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(key)
+	if ip == nil {
+		if len(key) > 0 && strings.Trim(key, "0123456789.") == "" {
+			return nil, fmt.Errorf("invalid address: %s (partial addresses are no longer prefixes, use a CIDR prefix, e.g. 10.10.0.0/16)", key)
+		}
+		return nil, fmt.Errorf("invalid address: %s", key)
+	}
+	bits := 128
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		bits = 32
+	}
+	if ip.IsUnspecified() {
+		bits = 0
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, len(ip)*8)}, nil
+}
+
+// catchAll indicates the key is the unspecified address (rather than a prefix)
+func catchAll(key string) bool {
+	ip := net.ParseIP(key)
+	return ip != nil && ip.IsUnspecified()
+}
+
+func newClientMappings(mappings map[string]string) (clientMappings, error) {
+	var m clientMappings
+	all := 0
+	for k, v := range mappings {
+		network, err := parseClientNetwork(k)
+		if err != nil {
+			return nil, err
+		}
+		mapping := &clientMapping{network: network, secret: []byte(v), all: catchAll(k)}
+		if mapping.all {
+			all++
+		}
+		m = append(m, mapping)
+	}
+	if all > 1 {
+		return nil, fmt.Errorf("duplicate catch-all client mapping")
+	}
+	sort.Slice(m, func(i, j int) bool {
+		a, _ := m[i].network.Mask.Size()
+		b, _ := m[j].network.Mask.Size()
+		if a != b {
+			return a > b
+		}
+		if m[i].all != m[j].all {
+			return !m[i].all
+		}
+		return m[i].network.String() < m[j].network.String()
+	})
+	seen := make(map[string]bool)
+	for _, c := range m {
+		network := c.network.String()
+		if seen[network] {
+			return nil, fmt.Errorf("duplicate client mapping: %s", network)
+		}
+		seen[network] = true
+	}
+	return m, nil
+}
+
+func parseSecretMappings(filename string) (clientMappings, error) {
+	if !core.PathExists(filename) {
+		return nil, fmt.Errorf("no secrets file")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	mappings := make(map[string]string)
+	line := 0
+	for scanner.Scan() {
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		idx := strings.IndexAny(l, " \t")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: no secret", line)
+		}
+		key := l[0:idx]
+		if _, ok := mappings[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate client mapping: %s", line, key)
+		}
+		if _, err := parseClientNetwork(key); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		mappings[key] = strings.TrimSpace(l[idx:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newClientMappings(mappings)
+}
+
+// lookup finds the secret of the longest prefix containing the address
+func (m clientMappings) lookup(ip net.IP) []byte {
+	if ip == nil {
+		return nil
+	}
+	for _, c := range m {
+		if c.all || c.network.Contains(ip) {
+			return c.secret
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseClientNetwork(t *testing.T) {
+	for k, v := range map[string]string{
+		"10.1.1.1":        "10.1.1.1/32",
+		"10.1.1.1/24":     "10.1.1.0/24",
+		"fd00::1":         "fd00::1/128",
+		"fd00::1/64":      "fd00::/64",
+		"::ffff:10.1.1.1": "10.1.1.1/32",
+		"0.0.0.0":         "0.0.0.0/0",
+		"::":              "::/0",
+	} {
+		n, err := parseClientNetwork(k)
+		if err != nil || n.String() != v {
+			t.Error("invalid network", k)
+		}
+	}
+	for _, k := range []string{"10.1.1.", "10.1.1.1/33", "host", ""} {
+		if _, err := parseClientNetwork(k); err == nil {
+			t.Error("should be invalid", k)
+		}
+	}
+	if _, err := parseClientNetwork("10.10"); err == nil || !strings.Contains(err.Error(), "use a CIDR prefix") {
+		t.Error("partial addresses should be migrated", err)
+	}
+}
+
+func TestClientMappings(t *testing.T) {
+	if _, err := newClientMappings(map[string]string{"10.0.0.0/8": "a", "10.1.1.1/8": "b"}); err == nil || err.Error() != "duplicate client mapping: 10.0.0.0/8" {
+		t.Error("duplicate network")
+	}
+	m := testMappings(t, map[string]string{"10.0.0.0/8": "a", "10.1.1.1": "b"})
+	if string(m.lookup(net.IPv4(10, 1, 1, 1))) != "b" || string(m.lookup(net.ParseIP("::ffff:10.1.1.2"))) != "a" {
+		t.Error("invalid lookup")
+	}
+}
+
+func TestCatchAllMapping(t *testing.T) {
+	m := testMappings(t, map[string]string{"10.0.0.0/8": "a", "0.0.0.0": "all"})
+	if string(m.lookup(net.IPv4(10, 1, 1, 1))) != "a" {
+		t.Error("longer prefixes win")
+	}
+	if string(m.lookup(net.IPv4(192, 168, 1, 1))) != "all" || string(m.lookup(net.ParseIP("fd00::1"))) != "all" {
+		t.Error("catch-all should match every client")
+	}
+	m = testMappings(t, map[string]string{"::/0": "v6", "0.0.0.0": "all"})
+	if string(m.lookup(net.ParseIP("fd00::1"))) != "v6" || string(m.lookup(net.IPv4(192, 168, 1, 1))) != "all" {
+		t.Error("prefixes win over the catch-all")
+	}
+	for _, mappings := range []map[string]string{
+		{"0.0.0.0": "a", "::": "b"},
+		{"0.0.0.0": "a", "0.0.0.0/0": "b"},
+	} {
+		if _, err := newClientMappings(mappings); err == nil {
+			t.Error("duplicate catch-all", mappings)
+		}
+	}
+}
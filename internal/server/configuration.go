@@ -1,28 +1,107 @@
 package server
 
 import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+
 	yaml "gopkg.in/yaml.v2"
 	"voidedtech.com/radiucal/internal/core"
 )
 
 type (
+	// Realm routes requests for users of a realm (e.g. user@realm or realm/user)
+	Realm struct {
+		Name      string
+		Match     string
+		Delimiter string
+		Servers   []string
+		Reject    bool
+		Strip     bool
+	}
+
+	// RewriteRule rewrites a request attribute (rewrite plugin)
+	RewriteRule struct {
+		Attribute string
+		Action    string
+		Value     string
+	}
+
+	// PluginConfig is a plugin to load, either just the plugin's name or a section naming the plugin, an alias for the
+	// instance (to load a plugin more than once), and options for the plugin
+	PluginConfig struct {
+		Name    string
+		Alias   string                 `yaml:",omitempty"`
+		Options map[string]interface{} `yaml:",omitempty"`
+	}
+
 	// Configuration is the configuration definition
 	Configuration struct {
-		Cache      bool
-		Host       string
-		Accounting bool
-		To         int
-		Bind       int
-		Dir        string
-		NoReject   bool
-		Log        string
-		Plugins    []string
-		Internals  struct {
+		Cache          bool
+		Host           string
+		Accounting     bool
+		To             int
+		Bind           int
+		AccountingBind int
+		Dir            string
+		NoReject       bool
+		Log            string
+		Plugins        []PluginConfig
+		Upstreams      struct {
+			Servers  []string
+			Mode     string
+			Timeout  int
+			Failures int
+			Holddown int
+			Pin      int
+		}
+		Realms  []Realm
+		Rewrite []RewriteRule
+		RadSec  struct {
+			Bind int
+			Cert string
+			Key  string
+			CA   string
+		}
+		Status struct {
+			Upstreams bool
+			Probe     int
+		}
+		CoA struct {
+			Bind int
+			Port int
+		}
+		Forward struct {
+			Accounting string
+			Timeout    int
+		}
+		Fallback struct {
+			MAB      bool
+			Users    string
+			Manifest string
+		}
+		Metrics struct {
+			Bind string
+			Path string
+		}
+		Connections struct {
+			Idle int
+			Max  int
+			Reap int
+		}
+		Workers struct {
+			Count int
+			Queue int
+		}
+		Internals struct {
 			NoInterrupt bool
 			NoLogs      bool
 			Logs        int
 			Lifespan    int
 			SpanCheck   int
+			Drain       int
 			LifeHours   []int
 		}
 		Disable struct {
@@ -30,10 +109,123 @@ type (
 			Preauth    []string
 			Trace      []string
 			Postauth   []string
+			CoA        []string
 		}
+		// RequireAuthenticator requires a Message-Authenticator in every Access-Request (so PAP and MAB requests can
+		// be verified against the client's secret)
+		RequireAuthenticator bool
 	}
 )
 
+// LoadConfiguration reads a configuration file and sets defaults
+func LoadConfiguration(file string) (*Configuration, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Configuration{}
+	if err := yaml.Unmarshal(b, conf); err != nil {
+		return nil, err
+	}
+	conf.Defaults(b)
+	seen := make(map[string]bool)
+	for _, p := range conf.Plugins {
+		if len(p.Name) == 0 {
+			return nil, fmt.Errorf("plugins require a name")
+		}
+		if seen[p.Instance()] {
+			return nil, fmt.Errorf("duplicate plugin instance: %s (set an alias)", p.Instance())
+		}
+		seen[p.Instance()] = true
+	}
+	return conf, nil
+}
+
+// UnmarshalYAML reads a plugin as a name or as a section
+func (p *PluginConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		p.Name = name
+		return nil
+	}
+	type section PluginConfig
+	return unmarshal((*section)(p))
+}
+
+// Instance is the name of the plugin instance (the alias, defaulting to the plugin name)
+func (p PluginConfig) Instance() string {
+	return defaultString(p.Alias, p.Name)
+}
+
+func (c *Configuration) plugin(instance string) (PluginConfig, bool) {
+	for _, p := range c.Plugins {
+		if p.Instance() == instance {
+			return p, true
+		}
+	}
+	return PluginConfig{}, false
+}
+
+// FallbackManifest is the manifest the MAB fallback accepts MACs from, the fallback manifest when set, otherwise the
+// manifest of the first usermac instance (manifest in the lib directory by default)
+func (c *Configuration) FallbackManifest() string {
+	manifest := c.Fallback.Manifest
+	if len(manifest) == 0 {
+		manifest = "manifest"
+		for _, p := range c.Plugins {
+			if p.Name != "usermac" {
+				continue
+			}
+			if m, ok := p.Options["manifest"].(string); ok && len(m) > 0 {
+				manifest = m
+			}
+			break
+		}
+	}
+	if filepath.IsAbs(manifest) {
+		return manifest
+	}
+	return filepath.Join(c.Dir, manifest)
+}
+
+func pluginInstances(plugins []PluginConfig) []string {
+	var instances []string
+	for _, p := range plugins {
+		instances = append(instances, p.Name+"/"+p.Instance())
+	}
+	return instances
+}
+
+// RequiresRestart reports the settings that differ in the next configuration but can not be reloaded
+func (c *Configuration) RequiresRestart(next *Configuration) []string {
+	var changed []string
+	for name, values := range map[string][]interface{}{
+		"accounting":     {c.Accounting, next.Accounting},
+		"accountingbind": {c.AccountingBind, next.AccountingBind},
+		"cache":          {c.Cache, next.Cache},
+		"coa":            {c.CoA, next.CoA},
+		"dir":            {c.Dir, next.Dir},
+		"fallback":       {c.Fallback, next.Fallback},
+		"bind":           {c.Bind, next.Bind},
+		"log":            {c.Log, next.Log},
+		"plugins":        {pluginInstances(c.Plugins), pluginInstances(next.Plugins)},
+		"upstreams":      {c.Upstreams, next.Upstreams},
+		"connections":    {c.Connections, next.Connections},
+		"internals":      {c.Internals, next.Internals},
+		"metrics":        {c.Metrics, next.Metrics},
+		"radsec":         {c.RadSec, next.RadSec},
+		"realms":         {c.Realms, next.Realms},
+		"status":         {c.Status, next.Status},
+		"workers":        {c.Workers, next.Workers},
+	} {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
 // Dump writes debug information about the configuration
 func (c *Configuration) Dump() {
 	config, err := yaml.Marshal(c)
@@ -63,6 +255,63 @@ func (c *Configuration) Defaults(backing []byte) {
 			c.Bind = 1812
 		}
 	}
+	if c.Accounting {
+		c.AccountingBind = 0
+	}
+	if c.To <= 0 {
+		c.To = 1814
+	}
+	if len(c.Upstreams.Servers) == 0 {
+		c.Upstreams.Servers = []string{fmt.Sprintf("%s:%d", c.Host, c.To)}
+	}
+	c.Upstreams.Mode = defaultString(c.Upstreams.Mode, FailoverSelect)
+	if c.Upstreams.Timeout <= 0 {
+		c.Upstreams.Timeout = 5
+	}
+	if c.Upstreams.Failures <= 0 {
+		c.Upstreams.Failures = 3
+	}
+	if c.Upstreams.Holddown <= 0 {
+		c.Upstreams.Holddown = 30
+	}
+	if c.Upstreams.Pin <= 0 {
+		c.Upstreams.Pin = 60
+	}
+	if c.CoA.Port <= 0 {
+		c.CoA.Port = DynamicPort
+	}
+	if c.Forward.Timeout <= 0 {
+		c.Forward.Timeout = 5
+	}
+	for i := range c.Realms {
+		r := &c.Realms[i]
+		r.Match = defaultString(r.Match, SuffixRealm)
+		if r.Match == PrefixRealm {
+			r.Delimiter = defaultString(r.Delimiter, "/")
+		} else {
+			r.Delimiter = defaultString(r.Delimiter, "@")
+		}
+	}
+	c.Metrics.Path = defaultString(c.Metrics.Path, "/metrics")
+	c.RadSec.Cert = defaultString(c.RadSec.Cert, "/etc/radiucal/hostapd/certs/server.pem")
+	c.RadSec.Key = defaultString(c.RadSec.Key, "/etc/radiucal/hostapd/certs/radsec.key")
+	c.RadSec.CA = defaultString(c.RadSec.CA, "/etc/radiucal/hostapd/certs/ca.pem")
+	c.Fallback.Users = defaultString(c.Fallback.Users, "/var/cache/radiucal/eap_users")
+	if c.Connections.Idle <= 0 {
+		c.Connections.Idle = 300
+	}
+	if c.Connections.Max <= 0 {
+		c.Connections.Max = 1024
+	}
+	if c.Connections.Reap <= 0 {
+		c.Connections.Reap = 30
+	}
+	if c.Workers.Count <= 0 {
+		c.Workers.Count = 8
+	}
+	if c.Workers.Queue <= 0 {
+		c.Workers.Queue = 256
+	}
 	if c.Internals.Logs <= 0 {
 		c.Internals.Logs = 10
 	}
@@ -72,6 +321,9 @@ func (c *Configuration) Defaults(backing []byte) {
 	if c.Internals.SpanCheck <= 0 {
 		c.Internals.SpanCheck = 1
 	}
+	if c.Internals.Drain <= 0 {
+		c.Internals.Drain = 5
+	}
 	if len(c.Internals.LifeHours) == 0 {
 		c.Internals.LifeHours = []int{22, 23, 0, 1, 2, 3, 4, 5}
 	}
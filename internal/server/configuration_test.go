@@ -1,6 +1,9 @@
 package server
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"voidedtech.com/radiucal/internal/core"
@@ -24,6 +27,31 @@ func TestDefaults(t *testing.T) {
 	if c.Bind != 1812 {
 		t.Error("invalid port")
 	}
+	if c.To != 1814 {
+		t.Error("invalid upstream port")
+	}
+	if c.AccountingBind != 0 {
+		t.Error("accounting should not be bound by default")
+	}
+	u := c.Upstreams
+	if len(u.Servers) != 1 || u.Servers[0] != "localhost:1814" {
+		t.Error("invalid upstream servers")
+	}
+	if u.Mode != FailoverSelect || u.Timeout != 5 || u.Failures != 3 || u.Holddown != 30 || u.Pin != 60 {
+		t.Error("invalid upstream defaults")
+	}
+	if c.Connections.Idle != 300 || c.Connections.Max != 1024 || c.Connections.Reap != 30 {
+		t.Error("invalid connection defaults")
+	}
+	if c.Fallback.MAB || c.Fallback.Users != "/var/cache/radiucal/eap_users" {
+		t.Error("invalid fallback defaults")
+	}
+	if c.Workers.Count != 8 || c.Workers.Queue != 256 {
+		t.Error("invalid worker defaults")
+	}
+	if c.Forward.Accounting != "" || c.Forward.Timeout != 5 {
+		t.Error("invalid forward defaults")
+	}
 	if c.Internals.Logs != 10 {
 		t.Error("invalid log buffer")
 	}
@@ -33,6 +61,9 @@ func TestDefaults(t *testing.T) {
 	if c.Internals.Lifespan != 12 {
 		t.Error("invalid lifespan")
 	}
+	if c.Internals.Drain != 5 {
+		t.Error("invalid drain")
+	}
 	l := c.Internals.LifeHours
 	for _, o := range []int{22, 23, 0, 1, 2, 3, 4, 5} {
 		if !core.IntegerIn(o, l) {
@@ -40,3 +71,101 @@ func TestDefaults(t *testing.T) {
 		}
 	}
 }
+
+func TestRequiresRestart(t *testing.T) {
+	c := &Configuration{}
+	c.Defaults([]byte{})
+	n := &Configuration{NoReject: true}
+	n.Defaults([]byte{})
+	if len(c.RequiresRestart(n)) != 0 {
+		t.Error("should be reloadable")
+	}
+	n.Bind = 1
+	n.Dir = "other"
+	n.Plugins = []PluginConfig{{Name: "log"}}
+	n.Upstreams.Servers = []string{"other:1812"}
+	changed := c.RequiresRestart(n)
+	if len(changed) != 4 || changed[0] != "bind" || changed[1] != "dir" || changed[2] != "plugins" || changed[3] != "upstreams" {
+		t.Error("should require restart", changed)
+	}
+	c.Plugins = []PluginConfig{{Name: "usermac", Alias: "guests"}}
+	n = &Configuration{}
+	n.Defaults([]byte{})
+	n.Plugins = []PluginConfig{{Name: "usermac", Alias: "guests", Options: map[string]interface{}{"manifest": "other"}}}
+	if len(c.RequiresRestart(n)) != 0 {
+		t.Error("plugin options should be reloadable")
+	}
+	n.Plugins[0].Alias = "other"
+	if changed := c.RequiresRestart(n); len(changed) != 1 || changed[0] != "plugins" {
+		t.Error("plugin instances should require restart", changed)
+	}
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	if _, err := LoadConfiguration("../../tests/nofile"); err == nil {
+		t.Error("no file")
+	}
+	c, err := LoadConfiguration("../../tests/test.acct.conf")
+	if err != nil {
+		t.Error("should load", err)
+	}
+	if !c.Accounting || c.Bind != 1813 || len(c.Plugins) != 2 {
+		t.Error("invalid configuration")
+	}
+}
+
+func TestPluginConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configuration")
+	if err != nil {
+		t.Fatal("unable to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "radiucal.conf")
+	ioutil.WriteFile(file, []byte(`
+plugins:
+    - log
+    - name: usermac
+    - name: usermac
+      alias: guests
+      options:
+        manifest: guests
+`), 0644)
+	c, err := LoadConfiguration(file)
+	if err != nil {
+		t.Fatal("should load", err)
+	}
+	if len(c.Plugins) != 3 {
+		t.Fatal("invalid plugins", c.Plugins)
+	}
+	if c.Plugins[0].Name != "log" || c.Plugins[0].Instance() != "log" || c.Plugins[1].Instance() != "usermac" {
+		t.Error("invalid plugin names", c.Plugins)
+	}
+	p, ok := c.plugin("guests")
+	if !ok || p.Name != "usermac" || p.Options["manifest"] != "guests" {
+		t.Error("invalid plugin instance", p)
+	}
+	opts := &struct{ Manifest string }{}
+	if err := NewPluginContext(c).ForPlugin(p).Options(opts); err != nil || opts.Manifest != "guests" {
+		t.Error("invalid plugin options", opts, err)
+	}
+	if err := NewPluginContext(c).ForPlugin(p).Options(&struct{}{}); err == nil {
+		t.Error("unknown options should fail")
+	}
+	if c.FallbackManifest() != filepath.Join(c.Dir, "manifest") {
+		t.Error("invalid fallback manifest", c.FallbackManifest())
+	}
+	c.Plugins[1].Options = map[string]interface{}{"manifest": "/etc/radiucal/manifest"}
+	if c.FallbackManifest() != "/etc/radiucal/manifest" {
+		t.Error("fallback should use the usermac manifest", c.FallbackManifest())
+	}
+	c.Fallback.Manifest = "mab"
+	if c.FallbackManifest() != filepath.Join(c.Dir, "mab") {
+		t.Error("fallback manifest should win", c.FallbackManifest())
+	}
+	for _, invalid := range []string{"plugins:\n  - usermac\n  - usermac\n", "plugins:\n  - alias: test\n"} {
+		ioutil.WriteFile(file, []byte(invalid), 0644)
+		if _, err := LoadConfiguration(file); err == nil {
+			t.Error("should fail", invalid)
+		}
+	}
+}
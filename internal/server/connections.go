@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	dialUpstream func(*net.UDPAddr) (*net.UDPConn, error)
+
+	// Connection is a client's dedicated socket to an upstream server
+	Connection struct {
+		Client   *net.UDPAddr
+		Server   *net.UDPConn
+		Upstream *Upstream
+		key      string
+		last     int64
+		done     chan struct{}
+		once     sync.Once
+	}
+
+	// ConnectionTable tracks upstream connections by client
+	ConnectionTable struct {
+		lock  *sync.Mutex
+		conns map[string]*Connection
+		idle  time.Duration
+		max   int
+		dial  dialUpstream
+	}
+)
+
+func dialUDP(srv *net.UDPAddr) (*net.UDPConn, error) {
+	return net.DialUDP("udp", nil, srv)
+}
+
+// NewConnectionTable creates a connection table which expires connections after being idle
+// and holds (at most) max connections
+func NewConnectionTable(idle time.Duration, max int) *ConnectionTable {
+	return &ConnectionTable{
+		lock:  &sync.Mutex{},
+		conns: make(map[string]*Connection),
+		idle:  idle,
+		max:   max,
+		dial:  dialUDP,
+	}
+}
+
+func connectionKey(cli, srv *net.UDPAddr) string {
+	return fmt.Sprintf("%s->%s", cli.String(), srv.String())
+}
+
+// Touch marks the connection as active
+func (c *Connection) Touch() {
+	c.touch(time.Now())
+}
+
+func (c *Connection) touch(t time.Time) {
+	atomic.StoreInt64(&c.last, t.UnixNano())
+}
+
+// LastActive is the time of the last activity on the connection
+func (c *Connection) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.last))
+}
+
+// Done is closed when the connection has been closed
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
+}
+
+// Closed indicates if the connection has been closed
+func (c *Connection) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the upstream socket (safe to call more than once)
+func (c *Connection) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		if c.Server != nil {
+			c.Server.Close()
+		}
+	})
+}
+
+// Get retrieves (or creates) the connection for a client to an upstream, indicating when new
+func (t *ConnectionTable) Get(cli *net.UDPAddr, up *Upstream) (*Connection, bool, error) {
+	key := connectionKey(cli, up.Addr)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if conn, ok := t.conns[key]; ok {
+		conn.Touch()
+		return conn, false, nil
+	}
+	if t.max > 0 && len(t.conns) >= t.max {
+		t.evictLocked()
+	}
+	server, err := t.dial(up.Addr)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := &Connection{Client: cli, Server: server, Upstream: up, key: key, done: make(chan struct{})}
+	conn.Touch()
+	t.conns[key] = conn
+	return conn, true, nil
+}
+
+func (t *ConnectionTable) evictLocked() {
+	var oldest *Connection
+	for _, c := range t.conns {
+		if oldest == nil || c.LastActive().Before(oldest.LastActive()) {
+			oldest = c
+		}
+	}
+	if oldest != nil {
+		delete(t.conns, oldest.key)
+		oldest.Close()
+	}
+}
+
+// Reap closes and removes connections idle since before the timeout, returning the count removed
+func (t *ConnectionTable) Reap(now time.Time) int {
+	if t.idle <= 0 {
+		return 0
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	count := 0
+	for k, c := range t.conns {
+		if now.Sub(c.LastActive()) < t.idle {
+			continue
+		}
+		delete(t.conns, k)
+		c.Close()
+		count++
+	}
+	return count
+}
+
+// Len is the number of active connections
+func (t *ConnectionTable) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.conns)
+}
+
+// Close closes all connections
+func (t *ConnectionTable) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for k, c := range t.conns {
+		delete(t.conns, k)
+		c.Close()
+	}
+}
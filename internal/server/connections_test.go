@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestTable(t *testing.T, idle time.Duration, max int) (*ConnectionTable, *net.UDPConn) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("unable to listen", err)
+	}
+	return NewConnectionTable(idle, max), upstream
+}
+
+func testClient(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestConnectionGet(t *testing.T) {
+	table, upstream := newTestTable(t, time.Minute, 10)
+	defer upstream.Close()
+	defer table.Close()
+	srv := &Upstream{Addr: upstream.LocalAddr().(*net.UDPAddr)}
+	c, created, err := table.Get(testClient(1000), srv)
+	if err != nil || !created || c == nil {
+		t.Error("should create connection")
+	}
+	o, created, err := table.Get(testClient(1000), srv)
+	if err != nil || created || o != c {
+		t.Error("should reuse connection")
+	}
+	if _, created, _ = table.Get(testClient(1001), srv); !created {
+		t.Error("new client, new connection")
+	}
+	if table.Len() != 2 {
+		t.Error("invalid table size")
+	}
+}
+
+func TestConnectionReap(t *testing.T) {
+	table, upstream := newTestTable(t, time.Minute, 10)
+	defer upstream.Close()
+	srv := &Upstream{Addr: upstream.LocalAddr().(*net.UDPAddr)}
+	old, _, _ := table.Get(testClient(1000), srv)
+	recent, _, _ := table.Get(testClient(1001), srv)
+	now := time.Now()
+	old.touch(now.Add(-2 * time.Minute))
+	if table.Reap(now) != 1 {
+		t.Error("should reap idle connection")
+	}
+	if !old.Closed() || recent.Closed() {
+		t.Error("wrong connection closed")
+	}
+	select {
+	case <-old.Done():
+	default:
+		t.Error("done should be signaled")
+	}
+	if _, err := old.Server.Read(make([]byte, 1)); err == nil {
+		t.Error("socket should be closed")
+	}
+	if table.Len() != 1 {
+		t.Error("invalid table size")
+	}
+	table.Close()
+	if table.Len() != 0 || !recent.Closed() {
+		t.Error("table should be empty")
+	}
+	if NewConnectionTable(0, 0).Reap(now) != 0 {
+		t.Error("no idle timeout, nothing to reap")
+	}
+}
+
+func TestConnectionMax(t *testing.T) {
+	table, upstream := newTestTable(t, time.Minute, 2)
+	defer upstream.Close()
+	defer table.Close()
+	srv := &Upstream{Addr: upstream.LocalAddr().(*net.UDPAddr)}
+	first, _, _ := table.Get(testClient(1000), srv)
+	second, _, _ := table.Get(testClient(1001), srv)
+	now := time.Now()
+	first.touch(now.Add(-time.Second))
+	second.touch(now)
+	table.Get(testClient(1002), srv)
+	if table.Len() != 2 {
+		t.Error("table should be capped")
+	}
+	if !first.Closed() || second.Closed() {
+		t.Error("least recently active should be evicted")
+	}
+}
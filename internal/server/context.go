@@ -2,12 +2,13 @@ package server
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"layeh.com/radius"
 	"voidedtech.com/radiucal/internal/core"
@@ -17,12 +18,14 @@ const (
 	preMode  authingMode = 0
 	postMode authingMode = 1
 	localKey             = "127.0.0.1"
-	allKey               = "0.0.0.0"
 	// failure of auth reasons
 	successCode   ReasonCode = 0
 	badSecretCode ReasonCode = 1
 	preAuthCode   ReasonCode = 2
 	postAuthCode  ReasonCode = 3
+	acctCode      ReasonCode = 4
+	badAuthCode   ReasonCode = 5
+	dynamicCode   ReasonCode = 6
 )
 
 type (
@@ -41,23 +44,63 @@ type (
 	// Context is the server's operating context
 	Context struct {
 		Debug     bool
+		lock      sync.RWMutex
 		secret    []byte
 		preauths  []PreAuth
 		postauths []PostAuth
 		accts     []Accounting
+		dynamics  []Dynamic
 		traces    []Tracing
 		modules   []Module
-		secrets   map[string][]byte
+		instances []string
+		secrets   clientMappings
 		noReject  bool
+		// dir is the lib directory loaded at startup (changing it requires a restart)
+		dir string
+		// requireAuthenticator rejects access requests without a Message-Authenticator
+		requireAuthenticator bool
+		forward              string
+		timeout              time.Duration
+		// accounting being forwarded (by client request)
+		forwardLock sync.Mutex
+		forwarding  map[string]bool
 		// shortcuts
 		postauth bool
 		preauth  bool
 		acct     bool
+		dynamic  bool
 		trace    bool
 		module   bool
 	}
 )
 
+func (m authingMode) String() string {
+	if m == postMode {
+		return "post"
+	}
+	return "pre"
+}
+
+func (r ReasonCode) String() string {
+	switch r {
+	case successCode:
+		return "success"
+	case badSecretCode:
+		return "badsecret"
+	case preAuthCode:
+		return "preauth"
+	case postAuthCode:
+		return "postauth"
+	case acctCode:
+		return "accounting"
+	case badAuthCode:
+		return "badauthenticator"
+	case dynamicCode:
+		return DynamicMode
+	}
+	return fmt.Sprintf("unknown(%d)", int(r))
+}
+
 // AddTrace adds a tracing check to the context
 func (ctx *Context) AddTrace(t Tracing) {
 	ctx.trace = true
@@ -76,10 +119,23 @@ func (ctx *Context) AddPostAuth(p PostAuth) {
 	ctx.postauths = append(ctx.postauths, p)
 }
 
+// AddDynamic adds a dynamic authorization (CoA/Disconnect) check to the context
+func (ctx *Context) AddDynamic(d Dynamic) {
+	ctx.dynamic = true
+	ctx.dynamics = append(ctx.dynamics, d)
+}
+
 // AddModule adds a general model to the context
 func (ctx *Context) AddModule(m Module) {
 	ctx.module = true
 	ctx.modules = append(ctx.modules, m)
+	ctx.instances = append(ctx.instances, "")
+}
+
+// AddPlugin adds a module loaded for a plugin (instance) configuration, it is reloaded with the instance's options
+func (ctx *Context) AddPlugin(p PluginConfig, m Module) {
+	ctx.AddModule(m)
+	ctx.instances[len(ctx.instances)-1] = p.Instance()
 }
 
 // AddAccounting adds an accounting check to the context
@@ -93,6 +149,25 @@ func PostAuthorize(ctx *Context, b []byte, addr *net.UDPAddr) (*ClientPacket, Re
 	return ctx.doAuthing(b, addr, postMode)
 }
 
+// PostAuthorizeReply performs packet post-authorization of a reply to the request with the given authenticator,
+// allowing modules to modify the reply
+func PostAuthorizeReply(authenticator [16]byte) AuthorizePacket {
+	return func(ctx *Context, b []byte, addr *net.UDPAddr) (*ClientPacket, ReasonCode) {
+		p := NewClientPacket(b, addr)
+		p.request = authenticator[:]
+		return p, ctx.authorize(p, postMode)
+	}
+}
+
+// PreAuthorizeSigned performs a packet pre-check of a request the proxy signed (with the given secret) for a client
+func PreAuthorizeSigned(secret []byte) AuthorizePacket {
+	return func(ctx *Context, b []byte, addr *net.UDPAddr) (*ClientPacket, ReasonCode) {
+		p := NewClientPacket(b, addr)
+		p.signed = secret
+		return p, ctx.authorize(p, preMode)
+	}
+}
+
 // PreAuthorize performs a packet pre-check (before radius check)
 func PreAuthorize(ctx *Context, b []byte, addr *net.UDPAddr) (*ClientPacket, ReasonCode) {
 	return ctx.doAuthing(b, addr, preMode)
@@ -107,6 +182,12 @@ func (ctx *Context) authorize(packet *ClientPacket, mode authingMode) ReasonCode
 	if packet == nil {
 		return successCode
 	}
+	valid := ctx.authorizing(packet, mode)
+	authMetric.Inc(mode.String(), valid.String())
+	return valid
+}
+
+func (ctx *Context) authorizing(packet *ClientPacket, mode authingMode) ReasonCode {
 	valid := successCode
 	traceMode := NoTrace
 	preauthing := false
@@ -125,15 +206,15 @@ func (ctx *Context) authorize(packet *ClientPacket, mode authingMode) ReasonCode
 	tracing := ctx.trace && traceMode != NoTrace
 	if preauthing || postauthing || tracing || receiving {
 		ctx.packet(packet)
+		if receiving {
+			received(packet)
+		}
 		// we may not be able to always read a packet during conversation
 		// especially during initial EAP phases
 		// we let that go
 		if packet.Error == nil {
 			if receiving {
-				if err := ctx.checkSecret(packet); err != nil {
-					core.WriteError("invalid radius secret", err)
-					valid = badSecretCode
-				}
+				valid = ctx.checkSecret(packet)
 			}
 			var checks []Module
 			var checking authCheck
@@ -160,6 +241,18 @@ func (ctx *Context) authorize(packet *ClientPacket, mode authingMode) ReasonCode
 					}
 				}
 			}
+			if packet.Modified && valid == successCode && (preauthing || postauthing) {
+				var err error
+				if preauthing {
+					err = rewritePacket(packet)
+				} else {
+					err = ctx.rewriteReply(packet)
+				}
+				if err != nil {
+					core.WriteError("unable to rewrite packet", err)
+					valid = code
+				}
+			}
 			if tracing {
 				for _, mod := range ctx.traces {
 					mod.Trace(traceMode, packet)
@@ -170,6 +263,45 @@ func (ctx *Context) authorize(packet *ClientPacket, mode authingMode) ReasonCode
 	return valid
 }
 
+// rewritePacket re-encodes a (modified) request, with the authenticators for the client's secret
+func rewritePacket(packet *ClientPacket) error {
+	b, err := EncodePacket(packet.Packet)
+	if err != nil {
+		return err
+	}
+	packet.Buffer = b
+	return nil
+}
+
+// rewriteReply re-encodes a (modified) reply, with the authenticators for the request it answers and the
+// client's secret, a reply to a request no longer pending (e.g. it timed out) is relayed unmodified
+func (ctx *Context) rewriteReply(packet *ClientPacket) error {
+	if len(packet.request) != 16 {
+		core.WriteWarn("unknown request authenticator, relaying the reply unmodified")
+		return nil
+	}
+	secret := ctx.clientSecret(packet.ClientAddr)
+	if secret == nil {
+		secret = ctx.sharedSecret()
+	}
+	request := make([]byte, 20)
+	copy(request[4:], packet.request)
+	// only authentic replies are re-signed
+	if !radius.IsAuthenticResponse(packet.Buffer, request, secret) {
+		return fmt.Errorf("reply authenticator mismatch")
+	}
+	p := packet.Packet
+	p.Identifier = packet.Buffer[1]
+	copy(p.Authenticator[:], packet.request)
+	p.Secret = secret
+	b, err := EncodePacket(p)
+	if err != nil {
+		return err
+	}
+	packet.Buffer = b
+	return nil
+}
+
 func getAuthChecker(preauthing bool) authCheck {
 	return func(m Module, p *ClientPacket) bool {
 		if preauthing {
@@ -193,172 +325,277 @@ func checkAuthMods(modules []Module, packet *ClientPacket, fxn authCheck) bool {
 
 // FromConfig parses config data into a Context object
 func (ctx *Context) FromConfig(libPath string, c *Configuration) {
+	secret, mappings, err := loadSecrets(libPath)
+	if err != nil {
+		core.Fatal("unable to load secrets", err)
+	}
+	dict, err := LoadDictionaries(libPath)
+	if err != nil {
+		core.Fatal("unable to load dictionaries", err)
+	}
+	SetDictionary(dict)
+	ctx.dir = libPath
 	ctx.noReject = c.NoReject
-	secrets := filepath.Join(libPath, "secrets")
-	ctx.parseSecrets(secrets)
-	ctx.secrets = make(map[string][]byte)
-	secrets = filepath.Join(libPath, "clients")
-	if core.PathExists(secrets) {
-		mappings, err := parseSecretMappings(secrets)
-		if err != nil {
-			core.Fatal("invalid client secret mappings", err)
+	ctx.requireAuthenticator = c.RequireAuthenticator
+	ctx.secret = secret
+	ctx.secrets = mappings
+	ctx.forward = c.Forward.Accounting
+	ctx.timeout = time.Duration(c.Forward.Timeout) * time.Second
+}
+
+// Teardown gives every module the chance to flush its state before exiting
+func (ctx *Context) Teardown() {
+	for _, m := range ctx.modules {
+		t, ok := m.(Teardown)
+		if !ok {
+			continue
 		}
-		for k, v := range mappings {
-			ctx.secrets[k] = []byte(v)
+		if err := t.Teardown(); err != nil {
+			core.WriteError(fmt.Sprintf("unable to teardown module: %s", m.Name()), err)
 		}
 	}
 }
 
-func parseSecretMappings(filename string) (map[string][]byte, error) {
-	mappings, err := parseSecretFromFile(filename, true)
+// Reload re-reads secrets (and dictionaries) and reloads all modules using a (new) configuration, from the lib
+// directory loaded at startup
+func (ctx *Context) Reload(c *Configuration) error {
+	if len(ctx.dir) > 0 && ctx.dir != c.Dir {
+		running := *c
+		running.Dir = ctx.dir
+		c = &running
+	}
+	secret, mappings, err := loadSecrets(c.Dir)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	dict, err := LoadDictionaries(c.Dir)
+	if err != nil {
+		return err
+	}
+	SetDictionary(dict)
+	pCtx := NewPluginContext(c)
+	var failed []string
+	for idx, m := range ctx.modules {
+		r, ok := m.(Reloading)
+		if !ok {
+			continue
+		}
+		mCtx := pCtx.CloneContext()
+		if p, ok := c.plugin(ctx.instances[idx]); ok {
+			mCtx = pCtx.ForPlugin(p)
+		}
+		if err := r.Reload(mCtx); err != nil {
+			core.WriteError(fmt.Sprintf("unable to reload module: %s", m.Name()), err)
+			failed = append(failed, m.Name())
+		}
 	}
-	m := make(map[string][]byte)
-	for k, v := range mappings {
-		m[k] = []byte(v)
+	ctx.lock.Lock()
+	ctx.noReject = c.NoReject
+	ctx.requireAuthenticator = c.RequireAuthenticator
+	ctx.secret = secret
+	ctx.secrets = mappings
+	ctx.forward = c.Forward.Accounting
+	ctx.timeout = time.Duration(c.Forward.Timeout) * time.Second
+	ctx.lock.Unlock()
+	if len(failed) > 0 {
+		return fmt.Errorf("modules failed to reload: %s", strings.Join(failed, ", "))
 	}
-	return m, nil
+	return nil
 }
 
-func (ctx *Context) parseSecrets(secretFile string) {
+func loadSecrets(libPath string) ([]byte, clientMappings, error) {
+	secretFile := filepath.Join(libPath, "secrets")
 	s, err := parseSecretFile(secretFile)
 	if err != nil {
-		core.Fatal(fmt.Sprintf("unable to read secrets: %s", secretFile), err)
+		return nil, nil, fmt.Errorf("unable to read secrets: %s (%v)", secretFile, err)
 	}
-	ctx.secret = []byte(s)
-}
-
-func parseSecretFile(secretFile string) (string, error) {
-	s, err := parseSecretFromFile(secretFile, false)
-	if err != nil {
-		return "", err
+	var mappings clientMappings
+	clientFile := filepath.Join(libPath, "clients")
+	if core.PathExists(clientFile) {
+		mappings, err = parseSecretMappings(clientFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid client secret mappings (%v)", err)
+		}
 	}
-	return s[localKey], nil
+	return []byte(s), mappings, nil
 }
 
-func parseSecretFromFile(secretFile string, mapping bool) (map[string]string, error) {
+func parseSecretFile(secretFile string) (string, error) {
 	if !core.PathExists(secretFile) {
-		return nil, fmt.Errorf("no secrets file")
+		return "", fmt.Errorf("no secrets file")
 	}
 	f, err := os.Open(secretFile)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer f.Close()
 	scanner := bufio.NewScanner(f)
-	lines := make(map[string]string)
 	for scanner.Scan() {
 		l := scanner.Text()
-		if strings.HasPrefix(l, "#") {
-			continue
-		}
-		if mapping || strings.HasPrefix(l, localKey) {
+		if strings.HasPrefix(l, localKey) {
 			parts := strings.Split(l, " ")
 			secret := strings.TrimSpace(strings.Join(parts[1:], " "))
 			if len(secret) > 0 {
-				if mapping {
-					lines[parts[0]] = secret
-				} else {
-					lines[localKey] = secret
-					break
-				}
+				return secret, nil
 			}
 		}
 	}
-	if len(lines) == 0 && !mapping {
-		return nil, fmt.Errorf("no secrets found")
-	}
-	return lines, nil
+	return "", fmt.Errorf("no secrets found")
 }
 
 // DebugDump dumps context information for debugging
 func (ctx *Context) DebugDump() {
 	if ctx.Debug {
+		ctx.lock.RLock()
+		defer ctx.lock.RUnlock()
 		core.WriteDebug("secret", string(ctx.secret))
 		if len(ctx.secrets) > 0 {
 			core.WriteDebug("client mappings")
-			for k, v := range ctx.secrets {
-				core.WriteDebug(k, string(v))
+			for _, m := range ctx.secrets {
+				core.WriteDebug(m.network.String(), string(m.secret))
 			}
 		}
 	}
 }
 
-func (ctx *Context) checkSecret(p *ClientPacket) error {
-	var inSecret []byte
+// checkSecret verifies a request against the client's secret (which is then used for the packet)
+func (ctx *Context) checkSecret(p *ClientPacket) ReasonCode {
 	if p == nil || p.Packet == nil {
-		return fmt.Errorf("no packet information")
+		core.WriteError("invalid radius secret", fmt.Errorf("no packet information"))
+		return badSecretCode
 	}
-	inSecret = p.Packet.Secret
-	if inSecret == nil {
-		return fmt.Errorf("no secret input")
+	secret := p.signed
+	if secret == nil {
+		secret = ctx.clientSecret(p.ClientAddr)
 	}
-	if len(ctx.secrets) > 0 {
-		if p.ClientAddr == nil {
-			return fmt.Errorf("no client addr")
-		}
-		ip := p.ClientAddr.String()
-		h, _, err := net.SplitHostPort(ip)
-		if err != nil {
-			return err
-		}
-		ip = h
-		good := false
-		core.WriteInfo(ip)
-		for k, v := range ctx.secrets {
-			if strings.HasPrefix(ip, k) || k == allKey {
-				if bytes.Equal(v, inSecret) {
-					good = true
-					break
-				}
-			}
-		}
-		if !good {
-			return fmt.Errorf("matches no secrets")
-		}
-	} else {
-		if !bytes.Equal(ctx.secret, inSecret) {
-			return fmt.Errorf("does not match shared secret")
-		}
+	if secret == nil {
+		core.WriteError("invalid radius secret", fmt.Errorf("matches no secrets"))
+		return badSecretCode
 	}
-	return nil
+	if err := verifyRequest(p.Buffer, secret, ctx.requiresAuthenticator()); err != nil {
+		core.WriteError("invalid radius secret", err)
+		return badAuthCode
+	}
+	p.Packet.Secret = secret
+	return successCode
+}
+
+func (ctx *Context) requiresAuthenticator() bool {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+	return ctx.requireAuthenticator
+}
+
+func (ctx *Context) sharedSecret() []byte {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+	return ctx.secret
+}
+
+// clientSecret finds the secret of a client (the longest matching prefix when mappings are used)
+func (ctx *Context) clientSecret(addr *net.UDPAddr) []byte {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+	if len(ctx.secrets) == 0 {
+		return ctx.secret
+	}
+	if addr == nil {
+		return nil
+	}
+	return ctx.secrets.lookup(addr.IP)
 }
 
 func (ctx *Context) packet(p *ClientPacket) {
+	ctx.parse(p, ctx.sharedSecret())
+}
+
+func (ctx *Context) parse(p *ClientPacket, secret []byte) {
 	if p.Error == nil && p.Packet == nil {
-		packet, err := radius.Parse(p.Buffer, ctx.secret)
+		packet, err := radius.Parse(p.Buffer, secret)
 		p.Error = err
 		p.Packet = packet
+		if err != nil {
+			parseMetric.Inc()
+		}
+	}
+}
+
+func received(p *ClientPacket) {
+	if p.Error != nil {
+		return
+	}
+	receivedMetric.Inc(p.Packet.Code.String())
+	if p.ClientAddr != nil {
+		nasMetric.Inc(p.ClientAddr.IP.String())
+	}
+}
+
+// traceDynamic traces dynamic authorization packets
+func (ctx *Context) traceDynamic(packet *ClientPacket) {
+	if ctx.trace {
+		for _, mod := range ctx.traces {
+			mod.Trace(TraceDynamic, packet)
+		}
+	}
+}
+
+// authorizeDynamic checks a dynamic authorization request with all dynamic modules, the request is only relayed when
+// every module accepts it
+func (ctx *Context) authorizeDynamic(packet *ClientPacket) ReasonCode {
+	valid := successCode
+	if ctx.dynamic {
+		for _, mod := range ctx.dynamics {
+			if !mod.Dynamic(packet) {
+				core.WriteDebug(fmt.Sprintf("dynamic authorization not relayed (failed: %s)", mod.Name()))
+				valid = dynamicCode
+			}
+		}
 	}
+	authMetric.Inc(DynamicMode, valid.String())
+	return valid
 }
 
-// Account is responsible for performing all accounting module operations
-func (ctx *Context) Account(packet *ClientPacket) {
-	ctx.packet(packet)
+// Account is responsible for performing all accounting module operations, the record is only accepted
+// when the request is authentic (for the client's secret) and all accounting modules accept it
+func (ctx *Context) Account(packet *ClientPacket) ReasonCode {
+	ctx.parse(packet, ctx.clientSecret(packet.ClientAddr))
+	received(packet)
 	if packet.Error != nil {
 		// unable to parse, exit early
-		return
+		return badSecretCode
+	}
+	if code := ctx.checkSecret(packet); code != successCode {
+		return code
 	}
+	valid := successCode
 	if ctx.acct {
 		for _, mod := range ctx.accts {
-			mod.Account(packet)
+			if !mod.Account(packet) {
+				core.WriteDebug(fmt.Sprintf("accounting not accepted (failed: %s)", mod.Name()))
+				valid = acctCode
+			}
 		}
 	}
+	return valid
 }
 
-// HandleAuth handles the actual authorization checks (e.g. pre, post, trace, etc.)
-func HandleAuth(fxn AuthorizePacket, ctx *Context, b []byte, addr *net.UDPAddr, write writeBack) bool {
+// HandleAuth handles the actual authorization checks (e.g. pre, post, trace, etc.), giving the packet to relay
+// (as rewritten by the modules)
+func HandleAuth(fxn AuthorizePacket, ctx *Context, b []byte, addr *net.UDPAddr, write writeBack) ([]byte, bool) {
 	packet, authCode := fxn(ctx, b, addr)
 	authed := authCode == successCode
 	if !authed {
-		if !ctx.noReject && write != nil && authCode != badSecretCode {
+		ctx.lock.RLock()
+		noReject := ctx.noReject
+		ctx.lock.RUnlock()
+		if !noReject && write != nil && authCode != badSecretCode && authCode != badAuthCode {
 			if packet.Error == nil {
 				p := packet.Packet
 				p = p.Response(radius.CodeAccessReject)
 				rej, err := p.Encode()
 				if err == nil {
 					core.WriteDebug("rejecting client")
+					rejectMetric.Inc()
 					write(rej)
 				} else {
 					if ctx.Debug {
@@ -372,5 +609,5 @@ func HandleAuth(fxn AuthorizePacket, ctx *Context, b []byte, addr *net.UDPAddr,
 			}
 		}
 	}
-	return authed
+	return packet.Buffer, authed
 }
@@ -2,11 +2,13 @@ package server
 
 import (
 	"bytes"
+	"fmt"
 	"net"
 	"testing"
 
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
 )
 
 type MockModule struct {
@@ -17,6 +19,8 @@ type MockModule struct {
 	reload int
 	post   int
 	unload int
+	// last reload's options
+	options map[string]interface{}
 	// TraceType
 	preAuth  int
 	postAuth int
@@ -35,6 +39,26 @@ func (m *MockModule) Setup(c *PluginContext) error {
 	return nil
 }
 
+func (m *MockModule) Reload(c *PluginContext) error {
+	m.reload++
+	m.options = make(map[string]interface{})
+	if err := c.Options(&m.options); err != nil {
+		return err
+	}
+	if m.fail {
+		return fmt.Errorf("reload failed")
+	}
+	return nil
+}
+
+func (m *MockModule) Teardown() error {
+	m.unload++
+	if m.fail {
+		return fmt.Errorf("teardown failed")
+	}
+	return nil
+}
+
 func (m *MockModule) Pre(p *ClientPacket) bool {
 	m.pre++
 	return !m.fail
@@ -50,8 +74,9 @@ func (m *MockModule) Trace(t TraceType, p *ClientPacket) {
 	}
 }
 
-func (m *MockModule) Account(p *ClientPacket) {
+func (m *MockModule) Account(p *ClientPacket) bool {
 	m.acct++
+	return !m.fail
 }
 
 func TestPreAuthNoMods(t *testing.T) {
@@ -63,19 +88,18 @@ func TestPreAuthNoMods(t *testing.T) {
 
 func TestSecrets(t *testing.T) {
 	ctx, p := getPacket(t)
-	ctx.packet(p)
-	p.Packet.Secret = []byte("test")
-	if ctx.authorize(p, preMode) != badSecretCode {
+	ctx.secret = []byte("test")
+	if ctx.authorize(p, preMode) != badAuthCode {
 		t.Error("different secrets")
 	}
 	ctx, p = getPacket(t)
 	if ctx.authorize(p, preMode) != successCode {
 		t.Error("same secrets")
 	}
-	ctx.secrets = make(map[string][]byte)
-	ctx.secrets["10."] = []byte("invalid")
-	ctx.secrets["10.100."] = p.Packet.Secret
-	ctx.secrets["10.10.1."] = []byte("invalid")
+	secret := ctx.secret
+	ctx.secret = []byte("test")
+	mappings := map[string]string{"10.0.0.0/8": "invalid", "10.100.0.0/16": string(secret), "10.10.1.0/24": "invalid"}
+	ctx.secrets = testMappings(t, mappings)
 	if ctx.authorize(p, preMode) != badSecretCode {
 		t.Error("no addr but secrets")
 	}
@@ -84,21 +108,76 @@ func TestSecrets(t *testing.T) {
 		t.Error("invalid udp test addr")
 	}
 	p.ClientAddr = addr
-	if ctx.authorize(p, preMode) != badSecretCode {
+	if ctx.authorize(p, preMode) != badAuthCode {
 		t.Error("no matching secrets")
 	}
-	ctx.secrets["10.10.1.10"] = p.Packet.Secret
+	mappings["10.10.1.100"] = string(secret)
+	ctx.secrets = testMappings(t, mappings)
 	if ctx.authorize(p, preMode) != successCode {
 		t.Error("matching secrets")
 	}
-	ctx.secrets["10.10.1.10"] = []byte("failure")
-	if ctx.authorize(p, preMode) != badSecretCode {
+	if !bytes.Equal(p.Packet.Secret, secret) {
+		t.Error("packet should use the client secret")
+	}
+	mappings["10.10.1.100"] = "failure"
+	ctx.secrets = testMappings(t, mappings)
+	if ctx.authorize(p, preMode) != badAuthCode {
 		t.Error("no matching secrets, yet again")
 	}
-	ctx.secrets["0.0.0.0"] = p.Packet.Secret
+	ctx.secrets = testMappings(t, map[string]string{"0.0.0.0": string(secret)})
+	if ctx.authorize(p, preMode) != successCode {
+		t.Error("matching secrets")
+	}
+	ctx.secrets = testMappings(t, map[string]string{"0.0.0.0/0": string(secret), "192.168.0.0/16": "invalid"})
 	if ctx.authorize(p, preMode) != successCode {
 		t.Error("matching secrets")
 	}
+	p.ClientAddr = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1)}
+	if ctx.authorize(p, preMode) != badAuthCode {
+		t.Error("more specific secret")
+	}
+}
+
+func TestSignedSecret(t *testing.T) {
+	ctx, p := getPacket(t)
+	ctx.secrets = testMappings(t, map[string]string{"10.0.0.0/8": "other"})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	if _, code := PreAuthorize(ctx, p.Buffer, addr); code != badSecretCode {
+		t.Error("unmapped client")
+	}
+	signed, code := PreAuthorizeSigned(ctx.secret)(ctx, p.Buffer, addr)
+	if code != successCode || !bytes.Equal(signed.Packet.Secret, ctx.secret) {
+		t.Error("requests signed by the proxy use the signing secret", code)
+	}
+	if _, code := PreAuthorizeSigned([]byte("other"))(ctx, p.Buffer, addr); code != badAuthCode {
+		t.Error("signing secret must match")
+	}
+}
+
+func TestRequireAuthenticator(t *testing.T) {
+	ctx, p := getPacket(t)
+	ctx.requireAuthenticator = true
+	if ctx.authorize(p, preMode) != successCode {
+		t.Error("request has a message authenticator")
+	}
+	unsigned := radius.New(radius.CodeAccessRequest, []byte("other"))
+	rfc2865.UserName_SetString(unsigned, "user")
+	b, _ := unsigned.Encode()
+	if ctx.authorize(NewClientPacket(b, nil), preMode) != badAuthCode {
+		t.Error("message authenticator is required")
+	}
+	ctx.requireAuthenticator = false
+	if ctx.authorize(NewClientPacket(b, nil), preMode) != successCode {
+		t.Error("requests without a message authenticator can not be verified")
+	}
+}
+
+func testMappings(t *testing.T, mappings map[string]string) clientMappings {
+	m, err := newClientMappings(mappings)
+	if err != nil {
+		t.Fatal("invalid mappings", err)
+	}
+	return m
 }
 
 func checkAuthMode(t *testing.T, mode authingMode) {
@@ -178,7 +257,7 @@ func TestPreAuth(t *testing.T) {
 	checkAuthMode(t, preMode)
 }
 
-func getPacket(t *testing.T) (*Context, *ClientPacket) {
+func getPacket(t testing.TB) (*Context, *ClientPacket) {
 	c := &Context{}
 	c.secret = []byte("secret")
 	p := radius.New(radius.CodeAccessRequest, c.secret)
@@ -188,7 +267,8 @@ func getPacket(t *testing.T) (*Context, *ClientPacket) {
 	if err := rfc2865.CallingStationID_AddString(p, "11-22-33-44-55-66"); err != nil {
 		t.Error("unable to add calling statiron")
 	}
-	b, err := p.Encode()
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, err := EncodePacket(p)
 	if err != nil {
 		t.Error("unable to encode")
 	}
@@ -197,7 +277,7 @@ func getPacket(t *testing.T) (*Context, *ClientPacket) {
 
 func checkOneSecret(dir, filename, ip, secret string, t *testing.T) {
 	s, err := parseSecretMappings(dir + filename)
-	if len(s) != 1 || err != nil || !bytes.Equal(s[ip], []byte(secret)) {
+	if len(s) != 1 || err != nil || !bytes.Equal(s.lookup(net.ParseIP(ip)), []byte(secret)) {
 		t.Error("invalid secret: " + filename)
 	}
 }
@@ -214,9 +294,13 @@ func TestSecretMappings(t *testing.T) {
 	}
 	checkOneSecret(dir, "nosecrets", "192.168.1.1", "nosecret", t)
 	checkOneSecret(dir, "onesecret", "127.0.0.1", "mysecretkey", t)
-	s, err = parseSecretMappings(dir + "noopsecret")
-	if len(s) != 0 || err != nil {
-		t.Error("file is empty")
+	_, err = parseSecretMappings(dir + "noopsecret")
+	if err == nil || err.Error() != "line 1: no secret" {
+		t.Error("mapping without a secret")
+	}
+	_, err = parseSecretMappings(dir + "badsecrets")
+	if err == nil || err.Error() != "line 3: invalid prefix: 10.300.0.0/16" {
+		t.Error("malformed mapping")
 	}
 	s, err = parseSecretMappings(dir + "multisecret")
 	if err != nil {
@@ -231,10 +315,32 @@ func TestSecretMappings(t *testing.T) {
 	expected["127.0.0.1"] = "test"
 	expected["10.10.10.10"] = "xyz"
 	for k, v := range expected {
-		if !bytes.Equal(s[k], []byte(v)) {
+		if !bytes.Equal(s.lookup(net.ParseIP(k)), []byte(v)) {
 			t.Error("mismatch mapping:" + k)
 		}
 	}
+	if s.lookup(net.ParseIP("10.10.10.100")) != nil {
+		t.Error("addresses match exactly")
+	}
+	s, err = parseSecretMappings(dir + "cidrsecrets")
+	if err != nil || len(s) != 6 {
+		t.Error("invalid cidr mappings", err)
+	}
+	expected = make(map[string]string)
+	expected["10.1.1.1"] = "exact"
+	expected["10.1.1.10"] = "narrow"
+	expected["10.2.1.1"] = "wide"
+	expected["192.168.1.1"] = "all"
+	expected["fd00::1"] = "six exact"
+	expected["fd00::2"] = "six with spaces"
+	for k, v := range expected {
+		if !bytes.Equal(s.lookup(net.ParseIP(k)), []byte(v)) {
+			t.Error("mismatch mapping:" + k)
+		}
+	}
+	if s.lookup(net.ParseIP("fd01::1")) != nil || s.lookup(nil) != nil {
+		t.Error("no matching mapping")
+	}
 }
 
 func TestSecretParsing(t *testing.T) {
@@ -287,3 +393,131 @@ func TestAcct(t *testing.T) {
 		t.Error("didn't account")
 	}
 }
+
+func TestReload(t *testing.T) {
+	ctx := &Context{}
+	m := &MockModule{}
+	ctx.AddModule(m)
+	c := &Configuration{Dir: "../../tests/", NoReject: true}
+	if err := ctx.Reload(c); err != nil {
+		t.Error("should reload", err)
+	}
+	if m.reload != 1 || string(ctx.secret) != "secret" || !ctx.noReject || len(ctx.secrets) != 0 {
+		t.Error("did not reload")
+	}
+	m.fail = true
+	if err := ctx.Reload(c); err == nil || err.Error() != "modules failed to reload: mock" {
+		t.Error("module should fail reload")
+	}
+	if m.reload != 2 {
+		t.Error("did not reload module")
+	}
+	ctx.secret = []byte("old")
+	c.Dir = "../../tests/nofile/"
+	if err := ctx.Reload(c); err == nil {
+		t.Error("should fail without secrets")
+	}
+	if m.reload != 2 || string(ctx.secret) != "old" {
+		t.Error("should not reload on invalid secrets")
+	}
+	ctx.FromConfig("../../tests/", &Configuration{})
+	ctx.secret = []byte("old")
+	if err := ctx.Reload(c); err == nil || string(ctx.secret) != "secret" || c.Dir != "../../tests/nofile/" {
+		t.Error("should reload from the running lib directory", err)
+	}
+}
+
+func TestReloadPlugin(t *testing.T) {
+	ctx := &Context{}
+	m := &MockModule{}
+	other := &MockModule{}
+	ctx.AddPlugin(PluginConfig{Name: "mock", Alias: "first"}, m)
+	ctx.AddPlugin(PluginConfig{Name: "mock", Alias: "second"}, other)
+	c := &Configuration{Dir: "../../tests/"}
+	c.Plugins = []PluginConfig{
+		{Name: "mock", Alias: "first", Options: map[string]interface{}{"value": "a"}},
+		{Name: "mock", Alias: "second", Options: map[string]interface{}{"value": "b"}},
+	}
+	if err := ctx.Reload(c); err != nil {
+		t.Error("should reload", err)
+	}
+	if m.options["value"] != "a" || other.options["value"] != "b" {
+		t.Error("plugins should reload with their options", m.options, other.options)
+	}
+}
+
+type renameModule struct {
+	MockModule
+}
+
+func (m *renameModule) Pre(p *ClientPacket) bool {
+	rfc2865.UserName_SetString(p.Packet, "renamed")
+	p.Modified = true
+	return true
+}
+
+func TestRewritePacket(t *testing.T) {
+	ctx, p := getPacket(t)
+	ctx.AddPreAuth(&renameModule{})
+	b, authed := HandleAuth(PreAuthorize, ctx, p.Buffer, nil, func(b []byte) {})
+	if !authed {
+		t.Error("should authorize")
+	}
+	if bytes.Equal(b, p.Buffer) {
+		t.Fatal("packet should be rewritten")
+	}
+	if err := verifyRequest(b, ctx.secret, false); err != nil {
+		t.Error("rewritten packet should be signed", err)
+	}
+	rewritten, err := radius.Parse(b, ctx.secret)
+	if err != nil || rfc2865.UserName_GetString(rewritten) != "renamed" {
+		t.Error("invalid rewritten packet")
+	}
+	if !bytes.Equal(b[4:20], p.Buffer[4:20]) {
+		t.Error("request authenticator should be kept")
+	}
+}
+
+type replyModule struct {
+	MockModule
+}
+
+func (m *replyModule) Post(p *ClientPacket) bool {
+	rfc2865.ReplyMessage_SetString(p.Packet, "welcome")
+	rfc2865.SessionTimeout_Set(p.Packet, 3600)
+	p.Modified = true
+	return true
+}
+
+func TestRewriteReply(t *testing.T) {
+	ctx, req := getPacket(t)
+	ctx.AddPostAuth(&replyModule{})
+	request, _ := radius.Parse(req.Buffer, ctx.secret)
+	resp := request.Response(radius.CodeAccessAccept)
+	rfc2869.MessageAuthenticator_Set(resp, make([]byte, 16))
+	b, err := EncodePacket(resp)
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	if unmodified, authed := HandleAuth(PostAuthorize, ctx, b, nil, nil); !authed || !bytes.Equal(unmodified, b) {
+		t.Error("reply without the request should be relayed unmodified")
+	}
+	var authenticator [16]byte
+	copy(authenticator[:], req.Buffer[4:20])
+	rewritten, authed := HandleAuth(PostAuthorizeReply(authenticator), ctx, b, nil, nil)
+	if !authed {
+		t.Fatal("should authorize")
+	}
+	if !radius.IsAuthenticResponse(rewritten, req.Buffer, ctx.secret) {
+		t.Error("rewritten reply should be authentic")
+	}
+	checkMessageAuthenticator(t, rewritten, ctx.secret, req.Buffer[4:20])
+	p, err := radius.Parse(rewritten, ctx.secret)
+	if err != nil || p.Identifier != request.Identifier || rfc2865.ReplyMessage_GetString(p) != "welcome" || rfc2865.SessionTimeout_Get(p) != 3600 {
+		t.Error("invalid rewritten reply")
+	}
+	b[len(b)-1]++
+	if _, authed := HandleAuth(PostAuthorizeReply(authenticator), ctx, b, nil, nil); authed {
+		t.Error("forged reply should not be rewritten")
+	}
+}
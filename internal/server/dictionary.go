@@ -0,0 +1,402 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/debug"
+	"layeh.com/radius/dictionary"
+	"layeh.com/radius/rfc2865"
+)
+
+const (
+	// dictionaryFiles are the (FreeRADIUS format) dictionaries loaded from the lib directory
+	dictionaryFiles = "dictionary*"
+)
+
+var (
+	dictionaryLock = &sync.RWMutex{}
+	dictionaries   = &Dictionary{dict: debug.IncludedDictionary}
+)
+
+type (
+	// Dictionary resolves attributes (including vendor-specific attributes) by name and number
+	Dictionary struct {
+		dict *dictionary.Dictionary
+	}
+
+	// DictionaryAttribute is an attribute definition (vendor-specific when Vendor is not 0)
+	DictionaryAttribute struct {
+		Name   string
+		Type   int
+		Vendor int
+		Kind   dictionary.AttributeType
+		attr   *dictionary.Attribute
+		values []*dictionary.Value
+		vendor *dictionary.Vendor
+	}
+
+	vendorAttribute struct {
+		kind  int
+		value []byte
+	}
+)
+
+// LoadDictionaries loads the FreeRADIUS format dictionaries (dictionary*) in a directory on top of the included
+// (RFC) dictionary
+func LoadDictionaries(dir string) (*Dictionary, error) {
+	files, err := filepath.Glob(filepath.Join(dir, dictionaryFiles))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	parser := &dictionary.Parser{
+		Opener:                    &dictionary.FileSystemOpener{Root: dir},
+		IgnoreIdenticalAttributes: true,
+	}
+	dict := debug.IncludedDictionary
+	for _, f := range files {
+		parsed, err := parser.ParseFile(f)
+		if err != nil {
+			return nil, err
+		}
+		dict, err = dictionary.Merge(dict, parsed)
+		if err != nil {
+			return nil, fmt.Errorf("unable to merge dictionary: %s (%v)", f, err)
+		}
+	}
+	return &Dictionary{dict: dict}, nil
+}
+
+// SetDictionary sets the dictionary used for packet dumps and by plugins
+func SetDictionary(d *Dictionary) {
+	dictionaryLock.Lock()
+	defer dictionaryLock.Unlock()
+	dictionaries = d
+}
+
+func currentDictionary() *Dictionary {
+	dictionaryLock.RLock()
+	defer dictionaryLock.RUnlock()
+	return dictionaries
+}
+
+// Vendors are the names of the loaded vendors
+func (d *Dictionary) Vendors() []string {
+	var vendors []string
+	for _, v := range d.dict.Vendors {
+		vendors = append(vendors, v.Name)
+	}
+	return vendors
+}
+
+// Attribute finds an attribute (standard or vendor-specific) by name (nil if it is unknown)
+func (d *Dictionary) Attribute(name string) *DictionaryAttribute {
+	if attr := dictionary.AttributeByName(d.dict.Attributes, name); attr != nil && len(attr.OID) == 1 {
+		return d.newAttribute(attr)
+	}
+	for _, v := range d.dict.Vendors {
+		if attr := dictionary.AttributeByName(v.Attributes, name); attr != nil && len(attr.OID) == 1 {
+			return newVendorAttribute(v, attr)
+		}
+	}
+	return nil
+}
+
+func (d *Dictionary) newAttribute(attr *dictionary.Attribute) *DictionaryAttribute {
+	return &DictionaryAttribute{
+		Name:   attr.Name,
+		Type:   attr.OID[0],
+		Kind:   attr.Type,
+		attr:   attr,
+		values: dictionary.ValuesByAttribute(d.dict.Values, attr.Name),
+	}
+}
+
+func newVendorAttribute(v *dictionary.Vendor, attr *dictionary.Attribute) *DictionaryAttribute {
+	return &DictionaryAttribute{
+		Name:   attr.Name,
+		Type:   attr.OID[0],
+		Vendor: v.Number,
+		Kind:   attr.Type,
+		attr:   attr,
+		values: dictionary.ValuesByAttribute(v.Values, attr.Name),
+		vendor: v,
+	}
+}
+
+// Encrypted indicates if the attribute is hidden using the shared secret (e.g. User-Password)
+func (a *DictionaryAttribute) Encrypted() bool {
+	return a.attr.FlagEncrypt.Valid
+}
+
+// Value finds the number of a named value of the attribute
+func (a *DictionaryAttribute) Value(name string) (uint32, bool) {
+	for _, v := range a.values {
+		if v.Name == name {
+			return uint32(v.Number), true
+		}
+	}
+	return 0, false
+}
+
+// Encode creates a value of the attribute from text (a string, a named value or number, or an address)
+func (a *DictionaryAttribute) Encode(value string) (radius.Attribute, error) {
+	switch a.Kind {
+	case dictionary.AttributeString, dictionary.AttributeOctets:
+		return radius.NewString(value)
+	case dictionary.AttributeInteger:
+		if number, ok := a.Value(value); ok {
+			return radius.NewInteger(number), nil
+		}
+		i, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer for %s: %s", a.Name, value)
+		}
+		return radius.NewInteger(uint32(i)), nil
+	case dictionary.AttributeIPAddr:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address for %s: %s", a.Name, value)
+		}
+		return radius.NewIPAddr(ip)
+	}
+	return nil, fmt.Errorf("unsupported attribute type for %s: %s", a.Name, a.Kind)
+}
+
+// Add adds an (encoded) value of the attribute to a packet, as a vendor-specific attribute for vendor attributes
+func (a *DictionaryAttribute) Add(p *radius.Packet, value radius.Attribute) error {
+	if a.Vendor == 0 {
+		p.Add(radius.Type(a.Type), value)
+		return nil
+	}
+	typeOctets := a.vendor.GetTypeOctets()
+	lengthOctets := a.vendor.GetLengthOctets()
+	header := typeOctets + lengthOctets
+	length := header + len(value)
+	if length > 253-4 || (lengthOctets == 1 && length > 255) {
+		return fmt.Errorf("value too long for %s", a.Name)
+	}
+	vsa := make([]byte, length)
+	for i := 0; i < typeOctets; i++ {
+		vsa[typeOctets-1-i] = byte(a.Type >> (8 * uint(i)))
+	}
+	for i := 0; i < lengthOctets; i++ {
+		vsa[header-1-i] = byte(length >> (8 * uint(i)))
+	}
+	copy(vsa[header:], value)
+	attr, err := radius.NewVendorSpecific(uint32(a.Vendor), vsa)
+	if err != nil {
+		return err
+	}
+	p.Add(rfc2865.VendorSpecific_Type, attr)
+	return nil
+}
+
+// Lookup gets all values of the attribute from a packet
+func (a *DictionaryAttribute) Lookup(p *radius.Packet) []radius.Attribute {
+	var results []radius.Attribute
+	for _, avp := range p.Attributes {
+		if a.Vendor == 0 {
+			if int(avp.Type) == a.Type {
+				results = append(results, avp.Attribute)
+			}
+			continue
+		}
+		if avp.Type != rfc2865.VendorSpecific_Type {
+			continue
+		}
+		vendor, vsa, err := radius.VendorSpecific(avp.Attribute)
+		if err != nil || int(vendor) != a.Vendor {
+			continue
+		}
+		attrs, err := splitVendorAttributes(a.vendor, vsa)
+		if err != nil {
+			continue
+		}
+		for _, v := range attrs {
+			if v.kind == a.Type {
+				results = append(results, v.value)
+			}
+		}
+	}
+	return results
+}
+
+// Format writes an attribute value as text (e.g. using the named values of the attribute)
+func (a *DictionaryAttribute) Format(value radius.Attribute) string {
+	return a.formatValue(value, nil)
+}
+
+// Text writes an attribute value as text, strings are not quoted
+func (a *DictionaryAttribute) Text(value radius.Attribute) string {
+	if a.Kind == dictionary.AttributeString {
+		return string(value)
+	}
+	return a.formatValue(value, nil)
+}
+
+func (a *DictionaryAttribute) formatValue(value radius.Attribute, p *radius.Packet) string {
+	result := ""
+	switch a.Kind {
+	case dictionary.AttributeString, dictionary.AttributeOctets:
+		if p != nil && a.attr.FlagEncrypt.Valid && a.attr.FlagEncrypt.Int == dictionary.EncryptUserPassword {
+			if decrypted, err := radius.UserPassword(value, p.Secret, p.Authenticator[:]); err == nil {
+				result = fmt.Sprintf("%q", decrypted)
+				break
+			}
+		}
+		result = fmt.Sprintf("%q", value)
+	case dictionary.AttributeDate:
+		if len(value) == 4 {
+			result = time.Unix(int64(binary.BigEndian.Uint32(value)), 0).UTC().Format(time.RFC3339)
+		}
+	case dictionary.AttributeInteger:
+		switch len(value) {
+		case 4:
+			number := uint64(binary.BigEndian.Uint32(value))
+			var names []string
+			for _, v := range a.values {
+				if v.Number == number {
+					names = append(names, v.Name)
+				}
+			}
+			if len(names) > 0 {
+				sort.Stable(sort.StringSlice(names))
+				result = strings.Join(names, " / ")
+				break
+			}
+			result = strconv.FormatUint(number, 10)
+		case 8:
+			result = strconv.FormatUint(binary.BigEndian.Uint64(value), 10)
+		}
+	case dictionary.AttributeInteger64:
+		if len(value) == 8 {
+			result = strconv.FormatUint(binary.BigEndian.Uint64(value), 10)
+		}
+	case dictionary.AttributeIPAddr, dictionary.AttributeIPv6Addr:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			result = net.IP(value).String()
+		}
+	case dictionary.AttributeIFID:
+		if len(value) == 8 {
+			result = net.HardwareAddr(value).String()
+		}
+	}
+	if len(result) == 0 {
+		result = "0x" + hex.EncodeToString(value)
+	}
+	return result
+}
+
+// splitVendorAttributes reads the attributes of a vendor-specific attribute using the vendor's format
+func splitVendorAttributes(v *dictionary.Vendor, vsa []byte) ([]vendorAttribute, error) {
+	typeOctets := v.GetTypeOctets()
+	lengthOctets := v.GetLengthOctets()
+	header := typeOctets + lengthOctets
+	var results []vendorAttribute
+	for len(vsa) > 0 {
+		if len(vsa) < header {
+			return nil, fmt.Errorf("invalid vendor attribute")
+		}
+		kind := 0
+		for _, b := range vsa[0:typeOctets] {
+			kind = kind<<8 | int(b)
+		}
+		length := len(vsa)
+		if lengthOctets > 0 {
+			length = 0
+			for _, b := range vsa[typeOctets:header] {
+				length = length<<8 | int(b)
+			}
+		}
+		if length < header || length > len(vsa) {
+			return nil, fmt.Errorf("invalid vendor attribute length")
+		}
+		results = append(results, vendorAttribute{kind: kind, value: vsa[header:length]})
+		vsa = vsa[length:]
+	}
+	return results, nil
+}
+
+// Dump writes a packet (code, identifier, and attributes) using the dictionary
+func (d *Dictionary) Dump(w io.Writer, p *radius.Packet) {
+	io.WriteString(w, fmt.Sprintf("%s Id %d\n", p.Code.String(), p.Identifier))
+	d.each(p, func(name string, attr *DictionaryAttribute, value radius.Attribute) {
+		text := "0x" + hex.EncodeToString(value)
+		if attr != nil {
+			text = attr.formatValue(value, p)
+		}
+		writeAttribute(w, name, text)
+	})
+}
+
+// Values are the attributes of a packet (as text) by name, encrypted attributes (e.g. User-Password) are not included
+func (d *Dictionary) Values(p *radius.Packet) map[string][]string {
+	values := make(map[string][]string)
+	d.each(p, func(name string, attr *DictionaryAttribute, value radius.Attribute) {
+		text := "0x" + hex.EncodeToString(value)
+		if attr != nil {
+			if attr.Encrypted() {
+				return
+			}
+			text = attr.Text(value)
+		}
+		values[name] = append(values[name], text)
+	})
+	return values
+}
+
+// each calls a function for every attribute of a packet (splitting the vendor-specific attributes of known vendors),
+// the definition is nil for unknown attributes
+func (d *Dictionary) each(p *radius.Packet, fxn func(string, *DictionaryAttribute, radius.Attribute)) {
+	for _, avp := range p.Attributes {
+		if avp.Type == rfc2865.VendorSpecific_Type && d.eachVendor(avp.Attribute, fxn) {
+			continue
+		}
+		if attr := dictionary.AttributeByOID(d.dict.Attributes, dictionary.OID{int(avp.Type)}); attr != nil {
+			fxn(attr.Name, d.newAttribute(attr), avp.Attribute)
+			continue
+		}
+		fxn("#"+strconv.Itoa(int(avp.Type)), nil, avp.Attribute)
+	}
+}
+
+// eachVendor calls a function for the attributes of a (known) vendor's vendor-specific attribute
+func (d *Dictionary) eachVendor(a radius.Attribute, fxn func(string, *DictionaryAttribute, radius.Attribute)) bool {
+	number, vsa, err := radius.VendorSpecific(a)
+	if err != nil {
+		return false
+	}
+	v := dictionary.VendorByNumber(d.dict.Vendors, int(number))
+	if v == nil {
+		return false
+	}
+	attrs, err := splitVendorAttributes(v, vsa)
+	if err != nil {
+		return false
+	}
+	for _, attr := range attrs {
+		def := dictionary.AttributeByOID(v.Attributes, dictionary.OID{attr.kind})
+		if def == nil {
+			fxn(fmt.Sprintf("%s-#%d", v.Name, attr.kind), nil, attr.value)
+			continue
+		}
+		fxn(def.Name, newVendorAttribute(v, def), attr.value)
+	}
+	return true
+}
+
+func writeAttribute(w io.Writer, name, value string) {
+	io.WriteString(w, fmt.Sprintf("  %s = %s\n", name, value))
+}
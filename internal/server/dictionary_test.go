@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/dictionary"
+	"layeh.com/radius/rfc2865"
+)
+
+const (
+	testCisco = `VENDOR Cisco 9
+BEGIN-VENDOR Cisco
+ATTRIBUTE Cisco-AVPair 1 string
+END-VENDOR Cisco`
+	testAruba = `VENDOR Aruba 14823
+BEGIN-VENDOR Aruba
+ATTRIBUTE Aruba-User-Role 1 string
+ATTRIBUTE Aruba-Device-Type 12 integer
+VALUE Aruba-Device-Type Phone 1
+END-VENDOR Aruba`
+)
+
+func newTestDictionaries(t *testing.T, files map[string]string) (*Dictionary, error) {
+	dir, err := ioutil.TempDir("", "dictionary")
+	if err != nil {
+		t.Fatal("unable to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	return LoadDictionaries(dir)
+}
+
+func addVendorSpecific(t *testing.T, p *radius.Packet, vendor uint32, vsa []byte) {
+	attr, err := radius.NewVendorSpecific(vendor, vsa)
+	if err != nil {
+		t.Fatal("invalid vendor attribute", err)
+	}
+	p.Add(rfc2865.VendorSpecific_Type, attr)
+}
+
+func TestLoadDictionaries(t *testing.T) {
+	d, err := LoadDictionaries("../../tests/nofile/")
+	if err != nil || d.Attribute("User-Name") == nil || len(d.Vendors()) != 0 {
+		t.Error("should only have the included dictionary", err)
+	}
+	d, err = newTestDictionaries(t, map[string]string{"dictionary.cisco": testCisco, "dictionary.aruba": testAruba, "secrets": "invalid"})
+	if err != nil {
+		t.Fatal("should load", err)
+	}
+	if strings.Join(d.Vendors(), ",") != "Aruba,Cisco" {
+		t.Error("invalid vendors", d.Vendors())
+	}
+	if _, err := newTestDictionaries(t, map[string]string{"dictionary.bad": "ATTRIBUTE"}); err == nil {
+		t.Error("invalid dictionary")
+	}
+	if _, err := newTestDictionaries(t, map[string]string{"dictionary.dup": "ATTRIBUTE User-Name 1 string"}); err == nil {
+		t.Error("conflicting attributes")
+	}
+}
+
+func TestDictionaryAttribute(t *testing.T) {
+	d, err := newTestDictionaries(t, map[string]string{"dictionary.cisco": testCisco, "dictionary.aruba": testAruba})
+	if err != nil {
+		t.Fatal("should load", err)
+	}
+	if d.Attribute("Not-An-Attribute") != nil {
+		t.Error("unknown attribute")
+	}
+	user := d.Attribute("User-Name")
+	if user == nil || user.Type != 1 || user.Vendor != 0 || user.Encrypted() {
+		t.Error("invalid standard attribute")
+	}
+	if !d.Attribute("User-Password").Encrypted() {
+		t.Error("password is encrypted")
+	}
+	device := d.Attribute("Aruba-Device-Type")
+	if device == nil || device.Type != 12 || device.Vendor != 14823 || device.Kind != dictionary.AttributeInteger {
+		t.Fatal("invalid vendor attribute")
+	}
+	if v, ok := device.Value("Phone"); !ok || v != 1 {
+		t.Error("invalid named value")
+	}
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	p.Identifier = 1
+	rfc2865.UserName_SetString(p, "user")
+	addVendorSpecific(t, p, 14823, append([]byte{1, 7, 'g', 'u', 'e', 's', 't'}, 12, 6, 0, 0, 0, 1))
+	addVendorSpecific(t, p, 9, []byte{1, 6, 'a', '=', 'b', 'c'})
+	if values := user.Lookup(p); len(values) != 1 || string(values[0]) != "user" {
+		t.Error("invalid standard lookup")
+	}
+	values := device.Lookup(p)
+	if len(values) != 1 || device.Format(values[0]) != "Phone" {
+		t.Error("invalid vendor lookup")
+	}
+	if values := d.Attribute("Cisco-AVPair").Lookup(p); len(values) != 1 || string(values[0]) != "a=bc" {
+		t.Error("invalid cisco lookup")
+	}
+	addVendorSpecific(t, p, 311, []byte{1, 3, 0})
+	var b bytes.Buffer
+	d.Dump(&b, p)
+	expect := `Access-Request Id 1
+  User-Name = "user"
+  Aruba-User-Role = "guest"
+  Aruba-Device-Type = Phone
+  Cisco-AVPair = "a=bc"
+  Vendor-Specific = 0x00000137010300`
+	if strings.TrimSpace(b.String()) != expect {
+		t.Error("invalid dump", b.String())
+	}
+	password, _ := radius.NewUserPassword([]byte("password12345678"), p.Secret, p.Authenticator[:])
+	p.Add(rfc2865.UserPassword_Type, password)
+	texts := d.Values(p)
+	if len(texts) != 5 || texts["User-Name"][0] != "user" || texts["Aruba-Device-Type"][0] != "Phone" || texts["Cisco-AVPair"][0] != "a=bc" {
+		t.Error("invalid values", texts)
+	}
+	if _, ok := texts["User-Password"]; ok {
+		t.Error("encrypted attributes should not be included")
+	}
+}
+
+func TestDictionaryEncode(t *testing.T) {
+	d, err := newTestDictionaries(t, map[string]string{"dictionary.aruba": testAruba})
+	if err != nil {
+		t.Fatal("should load", err)
+	}
+	p := radius.New(radius.CodeAccessAccept, []byte("secret"))
+	values := map[string]string{
+		"Reply-Message":     "hello",
+		"Service-Type":      "Framed-User",
+		"Session-Timeout":   "3600",
+		"Framed-IP-Address": "10.0.0.1",
+		"Aruba-User-Role":   "guest",
+		"Aruba-Device-Type": "Phone",
+	}
+	for name, value := range values {
+		attr := d.Attribute(name)
+		v, err := attr.Encode(value)
+		if err != nil {
+			t.Error("should encode", name, err)
+			continue
+		}
+		if err := attr.Add(p, v); err != nil {
+			t.Error("should add", name, err)
+		}
+	}
+	texts := d.Values(p)
+	for name, value := range values {
+		if len(texts[name]) != 1 || texts[name][0] != value {
+			t.Error("invalid value", name, texts[name])
+		}
+	}
+	for name, value := range map[string]string{"Session-Timeout": "never", "Framed-IP-Address": "host", "Service-Type": "Unknown"} {
+		if _, err := d.Attribute(name).Encode(value); err == nil {
+			t.Error("should not encode", name, value)
+		}
+	}
+}
+
+func TestSplitVendorAttributes(t *testing.T) {
+	two, none := 2, 0
+	v := &dictionary.Vendor{TypeOctets: &two, LengthOctets: &two}
+	attrs, err := splitVendorAttributes(v, []byte{0, 1, 0, 5, 'a', 1, 0, 0, 4})
+	if err != nil || len(attrs) != 2 || attrs[0].kind != 1 || string(attrs[0].value) != "a" || attrs[1].kind != 256 || len(attrs[1].value) != 0 {
+		t.Error("invalid 2,2 format", attrs, err)
+	}
+	v.LengthOctets = &none
+	attrs, err = splitVendorAttributes(v, []byte{0, 1, 'a', 'b'})
+	if err != nil || len(attrs) != 1 || string(attrs[0].value) != "ab" {
+		t.Error("invalid 2,0 format", attrs, err)
+	}
+	if _, err := splitVendorAttributes(&dictionary.Vendor{}, []byte{1, 9, 'a'}); err == nil {
+		t.Error("invalid length")
+	}
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc3162"
+	"layeh.com/radius/rfc3576"
+	"layeh.com/radius/rfc3580"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+const (
+	// DynamicPort is the dynamic authorization (CoA/Disconnect) port (RFC 5176)
+	DynamicPort = 3799
+	// dynamicWindow is how long a relayed request waits for the NAS
+	dynamicWindow = 30 * time.Second
+)
+
+type (
+	// DynamicSelectors identify the session(s) a dynamic authorization request applies to
+	DynamicSelectors struct {
+		UserName       string
+		CallingStation string
+		SessionID      string
+		// VLAN to change to (CoA only, 0 for none)
+		VLAN int
+	}
+
+	dynamicRequest struct {
+		client  *net.UDPAddr
+		secret  []byte
+		auth    [16]byte
+		relayed []byte
+		expires time.Time
+	}
+
+	// DynamicRelay relays dynamic authorization requests to the NAS (by NAS address) and the responses back
+	DynamicRelay struct {
+		ctx      *Context
+		conn     *net.UDPConn
+		port     int
+		lock     *sync.Mutex
+		requests map[string]dynamicRequest
+	}
+)
+
+// IsDynamicRequest indicates if a code is a CoA or Disconnect request
+func IsDynamicRequest(code radius.Code) bool {
+	return code == radius.CodeCoARequest || code == radius.CodeDisconnectRequest
+}
+
+func isDynamicResponse(code radius.Code) bool {
+	switch code {
+	case radius.CodeCoAACK, radius.CodeCoANAK, radius.CodeDisconnectACK, radius.CodeDisconnectNAK:
+		return true
+	}
+	return false
+}
+
+// NewDynamicRequest creates a CoA-Request (or Disconnect-Request) for a NAS
+func NewDynamicRequest(disconnect bool, secret []byte, nas net.IP, selectors DynamicSelectors) (*radius.Packet, error) {
+	code := radius.CodeCoARequest
+	if disconnect {
+		code = radius.CodeDisconnectRequest
+	}
+	if len(selectors.UserName) == 0 && len(selectors.CallingStation) == 0 && len(selectors.SessionID) == 0 {
+		return nil, fmt.Errorf("a user name, calling station, or session id is required")
+	}
+	if disconnect && selectors.VLAN > 0 {
+		return nil, fmt.Errorf("vlan changes are only supported for CoA")
+	}
+	p := radius.New(code, secret)
+	var err error
+	if v4 := nas.To4(); v4 != nil {
+		err = rfc2865.NASIPAddress_Set(p, v4)
+	} else if nas != nil {
+		err = rfc3162.NASIPv6Address_Set(p, nas)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(selectors.UserName) > 0 {
+		rfc2865.UserName_SetString(p, selectors.UserName)
+	}
+	if len(selectors.CallingStation) > 0 {
+		rfc2865.CallingStationID_SetString(p, selectors.CallingStation)
+	}
+	if len(selectors.SessionID) > 0 {
+		rfc2866.AcctSessionID_SetString(p, selectors.SessionID)
+	}
+	if selectors.VLAN > 0 {
+		rfc2868.TunnelType_Set(p, 0, rfc3580.TunnelType_Value_VLAN)
+		rfc2868.TunnelMediumType_Set(p, 0, rfc2868.TunnelMediumType_Value_IEEE802)
+		rfc2868.TunnelPrivateGroupID_SetString(p, 0, fmt.Sprintf("%d", selectors.VLAN))
+	}
+	return p, nil
+}
+
+// ExchangeDynamic sends a dynamic authorization request and waits for the (authentic) ACK/NAK
+func ExchangeDynamic(p *radius.Packet, addr string, timeout time.Duration) (*radius.Packet, error) {
+	req, err := EncodePacket(p)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	var buffer [radius.MaxPacketLength]byte
+	for {
+		n, err := conn.Read(buffer[0:])
+		if err != nil {
+			return nil, err
+		}
+		resp := buffer[0:n]
+		if len(resp) < 20 || resp[1] != req[1] {
+			continue
+		}
+		if !radius.IsAuthenticResponse(resp, req, p.Secret) {
+			return nil, fmt.Errorf("response is not authentic")
+		}
+		return radius.Parse(resp, p.Secret)
+	}
+}
+
+// LookupSecret finds the secret for a client (NAS) from the secrets (and clients) in a directory
+func LookupSecret(dir string, ip net.IP) ([]byte, error) {
+	secret, mappings, err := loadSecrets(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(mappings) == 0 {
+		return secret, nil
+	}
+	s := mappings.lookup(ip)
+	if s == nil {
+		return nil, fmt.Errorf("no client secret for %s", ip.String())
+	}
+	return s, nil
+}
+
+// NewDynamicRelay relays dynamic authorization received on the connection to NAS port
+func NewDynamicRelay(ctx *Context, conn *net.UDPConn, port int) *DynamicRelay {
+	return &DynamicRelay{ctx: ctx, conn: conn, port: port, lock: &sync.Mutex{}, requests: make(map[string]dynamicRequest)}
+}
+
+func dynamicKey(nas net.IP, identifier byte) string {
+	return fmt.Sprintf("%s/%d", nas.String(), identifier)
+}
+
+func nasAddress(p *radius.Packet) net.IP {
+	if ip := rfc2865.NASIPAddress_Get(p); ip != nil {
+		return ip
+	}
+	return rfc3162.NASIPv6Address_Get(p)
+}
+
+// Serve relays until the connection is closed
+func (d *DynamicRelay) Serve() error {
+	var buffer [radius.MaxPacketLength]byte
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buffer[0:])
+		if err != nil {
+			return err
+		}
+		buffered := append([]byte{}, buffer[0:n]...)
+		if len(buffered) < 20 {
+			continue
+		}
+		code := radius.Code(buffered[0])
+		if IsDynamicRequest(code) {
+			err = d.request(buffered, addr)
+		} else if isDynamicResponse(code) {
+			err = d.response(buffered, addr)
+		} else {
+			err = fmt.Errorf("unexpected packet: %s", code)
+		}
+		if err != nil {
+			core.WriteError("unable to relay dynamic authorization", err)
+		}
+	}
+}
+
+func (d *DynamicRelay) request(b []byte, addr *net.UDPAddr) error {
+	secret := d.ctx.clientSecret(addr)
+	if err := verifyRequest(b, secret, false); err != nil {
+		return err
+	}
+	p, err := radius.Parse(b, secret)
+	if err != nil {
+		return err
+	}
+	nas := nasAddress(p)
+	if nas == nil {
+		return fmt.Errorf("no NAS address in request")
+	}
+	nasSecret := d.ctx.clientSecret(&net.UDPAddr{IP: nas})
+	if nasSecret == nil {
+		return fmt.Errorf("no secret for NAS %s", nas.String())
+	}
+	relayed, err := ResignRequest(b, secret, nasSecret)
+	if err != nil {
+		return err
+	}
+	packet := &ClientPacket{ClientAddr: addr, Buffer: b, Packet: p}
+	d.ctx.traceDynamic(packet)
+	if code := d.ctx.authorizeDynamic(packet); code != successCode {
+		d.refuse(p, addr)
+		return fmt.Errorf("request from %s not authorized (%s)", addr.String(), code)
+	}
+	req := dynamicRequest{client: addr, secret: secret, relayed: relayed, expires: time.Now().Add(dynamicWindow)}
+	copy(req.auth[:], b[4:20])
+	now := time.Now()
+	d.lock.Lock()
+	for k, v := range d.requests {
+		if now.After(v.expires) {
+			delete(d.requests, k)
+		}
+	}
+	d.requests[dynamicKey(nas, b[1])] = req
+	d.lock.Unlock()
+	_, err = d.conn.WriteToUDP(relayed, &net.UDPAddr{IP: nas, Port: d.port})
+	return err
+}
+
+// refuse answers a request that is not relayed with a NAK (unless rejects are not sent)
+func (d *DynamicRelay) refuse(p *radius.Packet, addr *net.UDPAddr) {
+	d.ctx.lock.RLock()
+	noReject := d.ctx.noReject
+	d.ctx.lock.RUnlock()
+	if noReject {
+		return
+	}
+	code := radius.CodeCoANAK
+	if p.Code == radius.CodeDisconnectRequest {
+		code = radius.CodeDisconnectNAK
+	}
+	nak := p.Response(code)
+	rfc3576.ErrorCause_Set(nak, rfc3576.ErrorCause_Value_AdministrativelyProhibited)
+	resp, err := EncodePacket(nak)
+	if err != nil {
+		core.WriteError("unable to encode nak", err)
+		return
+	}
+	if _, err := d.conn.WriteToUDP(resp, addr); err != nil {
+		core.WriteError("unable to refuse dynamic authorization", err)
+	}
+}
+
+func (d *DynamicRelay) response(b []byte, addr *net.UDPAddr) error {
+	key := dynamicKey(addr.IP, b[1])
+	d.lock.Lock()
+	req, ok := d.requests[key]
+	if ok {
+		delete(d.requests, key)
+	}
+	d.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("response without request from %s", addr.String())
+	}
+	nasSecret := d.ctx.clientSecret(addr)
+	if !radius.IsAuthenticResponse(b, req.relayed, nasSecret) {
+		return fmt.Errorf("response is not authentic from %s", addr.String())
+	}
+	var nasAuth [16]byte
+	copy(nasAuth[:], req.relayed[4:20])
+	resp, err := ResignResponse(b, nasSecret, nasAuth, req.secret, req.auth)
+	if err != nil {
+		return err
+	}
+	p, err := radius.Parse(b, nasSecret)
+	if err == nil {
+		d.ctx.traceDynamic(&ClientPacket{ClientAddr: addr, Buffer: b, Packet: p})
+	}
+	_, err = d.conn.WriteToUDP(resp, req.client)
+	return err
+}
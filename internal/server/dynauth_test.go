@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc3162"
+	"layeh.com/radius/rfc3576"
+)
+
+type dynamicTracer struct {
+	MockModule
+	traced chan TraceType
+}
+
+func (d *dynamicTracer) Trace(t TraceType, p *ClientPacket) {
+	d.traced <- t
+}
+
+func (d *dynamicTracer) Dynamic(p *ClientPacket) bool {
+	return rfc2865.UserName_GetString(p.Packet) != "blocked"
+}
+
+func TestNewDynamicRequest(t *testing.T) {
+	secret := []byte("secret")
+	if _, err := NewDynamicRequest(false, secret, nil, DynamicSelectors{}); err == nil {
+		t.Error("selectors required")
+	}
+	if _, err := NewDynamicRequest(true, secret, nil, DynamicSelectors{UserName: "user", VLAN: 10}); err == nil {
+		t.Error("no vlan for disconnect")
+	}
+	p, err := NewDynamicRequest(false, secret, net.IPv4(10, 1, 1, 1), DynamicSelectors{UserName: "user", CallingStation: "aa-bb", SessionID: "1", VLAN: 10})
+	if err != nil || p.Code != radius.CodeCoARequest {
+		t.Fatal("invalid coa request", err)
+	}
+	if rfc2865.UserName_GetString(p) != "user" || rfc2865.CallingStationID_GetString(p) != "aa-bb" || rfc2866.AcctSessionID_GetString(p) != "1" {
+		t.Error("invalid selectors")
+	}
+	if !rfc2865.NASIPAddress_Get(p).Equal(net.IPv4(10, 1, 1, 1)) {
+		t.Error("invalid nas address")
+	}
+	if _, vlan := rfc2868.TunnelPrivateGroupID_GetString(p); vlan != "10" {
+		t.Error("invalid vlan")
+	}
+	p, _ = NewDynamicRequest(true, secret, net.ParseIP("fd00::1"), DynamicSelectors{SessionID: "1"})
+	if p.Code != radius.CodeDisconnectRequest || !rfc3162.NASIPv6Address_Get(p).Equal(net.ParseIP("fd00::1")) {
+		t.Error("invalid disconnect request")
+	}
+}
+
+func TestLookupSecret(t *testing.T) {
+	s, err := LookupSecret("../../tests/", net.IPv4(10, 1, 1, 1))
+	if err != nil || string(s) != "secret" {
+		t.Error("shared secret")
+	}
+	if _, err := LookupSecret("../../tests/invalid", net.IPv4(10, 1, 1, 1)); err == nil {
+		t.Error("no secrets")
+	}
+}
+
+func TestDynamicRelay(t *testing.T) {
+	secret := []byte("secret")
+	nas, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer nas.Close()
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		for {
+			n, addr, err := nas.ReadFromUDP(buffer[0:])
+			if err != nil {
+				return
+			}
+			if !radius.IsAuthenticRequest(buffer[0:n], secret) {
+				continue
+			}
+			req, _ := radius.Parse(buffer[0:n], secret)
+			code := radius.CodeCoAACK
+			if rfc2865.UserName_GetString(req) != "user" {
+				code = radius.CodeCoANAK
+			}
+			resp, _ := req.Response(code).Encode()
+			nas.WriteToUDP(resp, addr)
+		}
+	}()
+	ctx := &Context{secret: secret}
+	m := &dynamicTracer{traced: make(chan TraceType, 10)}
+	ctx.AddTrace(m)
+	ctx.AddDynamic(m)
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer conn.Close()
+	go NewDynamicRelay(ctx, conn, nas.LocalAddr().(*net.UDPAddr).Port).Serve()
+	p, _ := NewDynamicRequest(false, secret, net.IPv4(127, 0, 0, 1), DynamicSelectors{UserName: "user"})
+	resp, err := ExchangeDynamic(p, conn.LocalAddr().String(), 5*time.Second)
+	if err != nil || resp.Code != radius.CodeCoAACK {
+		t.Fatal("coa not relayed", err)
+	}
+	p, _ = NewDynamicRequest(false, secret, net.IPv4(127, 0, 0, 1), DynamicSelectors{UserName: "other"})
+	resp, err = ExchangeDynamic(p, conn.LocalAddr().String(), 5*time.Second)
+	if err != nil || resp.Code != radius.CodeCoANAK {
+		t.Error("nak not relayed", err)
+	}
+	p, _ = NewDynamicRequest(false, []byte("wrong"), net.IPv4(127, 0, 0, 1), DynamicSelectors{UserName: "user"})
+	if _, err := ExchangeDynamic(p, conn.LocalAddr().String(), 100*time.Millisecond); err == nil {
+		t.Error("invalid secret should not be relayed")
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case traced := <-m.traced:
+			if traced != TraceDynamic {
+				t.Error("invalid trace type")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("requests and responses should be traced")
+		}
+	}
+	p, _ = NewDynamicRequest(true, secret, net.IPv4(127, 0, 0, 1), DynamicSelectors{UserName: "blocked"})
+	resp, err = ExchangeDynamic(p, conn.LocalAddr().String(), 5*time.Second)
+	if err != nil || resp.Code != radius.CodeDisconnectNAK || rfc3576.ErrorCause_Get(resp) != rfc3576.ErrorCause_Value_AdministrativelyProhibited {
+		t.Error("plugins should refuse the request", err)
+	}
+	if len(m.traced) != 1 {
+		t.Error("refused requests are not relayed")
+	}
+}
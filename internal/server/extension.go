@@ -11,8 +11,8 @@ import (
 	"sync"
 	"time"
 
+	yaml "gopkg.in/yaml.v2"
 	"layeh.com/radius"
-	"layeh.com/radius/debug"
 	"voidedtech.com/radiucal/internal/core"
 )
 
@@ -21,6 +21,8 @@ const (
 	NoTrace TraceType = 0
 	// TraceRequest indicate to trace the request
 	TraceRequest TraceType = 1
+	// TraceDynamic indicates to trace dynamic authorization (CoA/Disconnect) requests and responses
+	TraceDynamic TraceType = 2
 	// AccountingMode for accounting
 	AccountingMode = "accounting"
 	// TracingMode for tracing
@@ -29,6 +31,8 @@ const (
 	PreAuthMode = "preauth"
 	// PostAuthMode for post-auth
 	PostAuthMode = "postauth"
+	// DynamicMode for dynamic authorization (CoA/Disconnect)
+	DynamicMode = "coa"
 )
 
 var (
@@ -53,8 +57,14 @@ type (
 	PluginContext struct {
 		// Backing config
 		config *Configuration
+		// Backing metrics
+		metrics *MetricRegistry
+		// Backing plugin options
+		options map[string]interface{}
 		// Lib represents the library path for radiucal
 		Lib string
+		// Alias is the configured name of the plugin instance (empty when not set)
+		Alias string
 	}
 
 	// Module represents a plugin module for packet checking
@@ -63,28 +73,48 @@ type (
 		Name() string
 	}
 
+	// Reloading represents the interface for modules that can reload their state
+	Reloading interface {
+		Module
+		Reload(*PluginContext) error
+	}
+
+	// Teardown represents the interface for modules that flush (and release) their state on shutdown
+	Teardown interface {
+		Module
+		Teardown() error
+	}
+
 	// PreAuth represents the interface required to pre-authorize a packet
 	PreAuth interface {
 		Module
 		Pre(*ClientPacket) bool
 	}
 
-	// PostAuth represents the interface required to post-authorize a packet
+	// PostAuth represents the interface required to post-authorize a packet (the upstream's reply), the reply may be
+	// edited (or replaced) by setting Modified
 	PostAuth interface {
 		Module
 		Post(*ClientPacket) bool
 	}
 
+	// Dynamic represents the interface required to authorize dynamic authorization (CoA/Disconnect) requests before
+	// they are relayed to the NAS (returning false if the request is not relayed)
+	Dynamic interface {
+		Module
+		Dynamic(*ClientPacket) bool
+	}
+
 	// Tracing represents the interface required to trace requests
 	Tracing interface {
 		Module
 		Trace(TraceType, *ClientPacket)
 	}
 
-	// Accounting represents the interface required to handle accounting
+	// Accounting represents the interface required to handle accounting (returning false if the record is not accepted)
 	Accounting interface {
 		Module
-		Account(*ClientPacket)
+		Account(*ClientPacket) bool
 	}
 
 	// ClientPacket represents the radius packet from the client
@@ -93,6 +123,12 @@ type (
 		Buffer     []byte
 		Packet     *radius.Packet
 		Error      error
+		// Modified indicates a module changed (or replaced) the packet, the pre-auth request or post-auth reply is
+		// re-encoded before being relayed
+		Modified bool
+		request  []byte
+		// signed is the secret of a request signed by the proxy (relayed radsec requests) rather than the client
+		signed []byte
 	}
 
 	// KeyValue represents a simple key/value object
@@ -117,13 +153,60 @@ func NewClientPacket(buffer []byte, addr *net.UDPAddr) *ClientPacket {
 func NewPluginContext(config *Configuration) *PluginContext {
 	p := &PluginContext{}
 	p.config = config
+	p.metrics = metrics
 	p.Lib = config.Dir
 	return p
 }
 
+// Metrics is the registry for plugins to register their own metrics
+func (p *PluginContext) Metrics() *MetricRegistry {
+	return p.metrics
+}
+
+// Rewrites are the configured request rewrite rules
+func (p *PluginContext) Rewrites() []RewriteRule {
+	return p.config.Rewrite
+}
+
+// Dictionary resolves attributes (including those of the loaded vendor dictionaries) by name
+func (p *PluginContext) Dictionary() *Dictionary {
+	return currentDictionary()
+}
+
+// InstanceName is the name of the plugin instance, the configured alias or the plugin's name
+func (p *PluginContext) InstanceName(name string) string {
+	return defaultString(p.Alias, name)
+}
+
+// Options reads the plugin's options into a plugin-defined structure, unknown options are an error
+func (p *PluginContext) Options(out interface{}) error {
+	if len(p.options) == 0 {
+		return nil
+	}
+	b, err := yaml.Marshal(p.options)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(b, out); err != nil {
+		return fmt.Errorf("invalid plugin options: %v", err)
+	}
+	return nil
+}
+
 // CloneContext a plugin context to a copy for use in other plugins
 func (p *PluginContext) CloneContext() *PluginContext {
-	return NewPluginContext(p.config)
+	c := NewPluginContext(p.config)
+	c.options = p.options
+	c.Alias = p.Alias
+	return c
+}
+
+// ForPlugin copies the context for a plugin (instance) with its configured alias and options
+func (p *PluginContext) ForPlugin(conf PluginConfig) *PluginContext {
+	c := NewPluginContext(p.config)
+	c.options = conf.Options
+	c.Alias = conf.Alias
+	return c
 }
 
 // NewRequestDump prepares a packet request for dumping
@@ -138,9 +221,7 @@ func (packet *RequestDump) DumpPacket(kv KeyValue) []string {
 	if packet.data.ClientAddr != nil {
 		io.WriteString(&w, fmt.Sprintf("UDPAddr = %s\n", packet.data.ClientAddr.String()))
 	}
-	conf := &debug.Config{}
-	conf.Dictionary = debug.IncludedDictionary
-	debug.Dump(&w, conf, packet.data.Packet)
+	currentDictionary().Dump(&w, packet.data.Packet)
 	results := []string{kv.String()}
 	for _, m := range strings.Split(w.String(), "\n") {
 		if len(m) == 0 {
@@ -151,6 +232,14 @@ func (packet *RequestDump) DumpPacket(kv KeyValue) []string {
 	return results
 }
 
+// TraceMode is the mode a trace type is written as
+func TraceMode(t TraceType) string {
+	if t == TraceDynamic {
+		return DynamicMode
+	}
+	return TracingMode
+}
+
 // Disabled indicates if a given mode is disabled
 func Disabled(mode string, modes []string) bool {
 	if len(modes) == 0 {
@@ -195,6 +284,7 @@ func DisabledModes(m Module, ctx *PluginContext) []string {
 	noTracing := isFlagged(ctx.config.Disable.Trace, name)
 	noPreauth := isFlagged(ctx.config.Disable.Preauth, name)
 	noPostauth := isFlagged(ctx.config.Disable.Postauth, name)
+	noDynamic := isFlagged(ctx.config.Disable.CoA, name)
 	var modes []string
 	if noAccounting {
 		modes = append(modes, AccountingMode)
@@ -208,6 +298,9 @@ func DisabledModes(m Module, ctx *PluginContext) []string {
 	if noPostauth {
 		modes = append(modes, PostAuthMode)
 	}
+	if noDynamic {
+		modes = append(modes, DynamicMode)
+	}
 	return modes
 }
 
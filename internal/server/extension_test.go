@@ -27,6 +27,19 @@ func TestDisabled(t *testing.T) {
 	}
 }
 
+func TestDisabledModes(t *testing.T) {
+	c := &Configuration{}
+	c.Disable.CoA = []string{"mock"}
+	c.Disable.Trace = []string{"other"}
+	modes := DisabledModes(&MockModule{}, NewPluginContext(c))
+	if len(modes) != 1 || modes[0] != DynamicMode {
+		t.Error("coa should be disabled")
+	}
+	if TraceMode(TraceDynamic) != DynamicMode || TraceMode(TraceRequest) != TracingMode {
+		t.Error("invalid trace modes")
+	}
+}
+
 func TestKeyValueStrings(t *testing.T) {
 	c := KeyValueStore{}
 	c.KeyValues = append(c.KeyValues, KeyValue{Key: "key", Value: "val"})
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+const (
+	// acceptAttribute is the hostapd (eap users) reply attribute setting
+	acceptAttribute = "radius_accept_attr="
+)
+
+var (
+	fallbackMetric = newCounter("radiucal_fallback_total", "MAB requests answered locally while the upstreams are down", "result")
+)
+
+type (
+	// MABFallback answers MAC authentication bypass (MAB) requests locally, from the usermac manifest and the
+	// (authem generated) hostapd users, while no upstream is responding
+	MABFallback struct {
+		ctx       *Context
+		upstreams *UpstreamPool
+		manifest  string
+		users     string
+		lock      *sync.RWMutex
+		macs      map[string]bool
+		accepts   map[string]radius.Attributes
+	}
+)
+
+// NewMABFallback loads the manifest and hostapd users for answering MAB while the upstreams are down
+func NewMABFallback(ctx *Context, upstreams *UpstreamPool, manifest, users string) (*MABFallback, error) {
+	f := &MABFallback{ctx: ctx, upstreams: upstreams, manifest: manifest, users: users, lock: &sync.RWMutex{}}
+	if err := f.Load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load (re)reads the manifest and the hostapd users
+func (f *MABFallback) Load() error {
+	b, err := ioutil.ReadFile(f.manifest)
+	if err != nil {
+		return err
+	}
+	macs := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			macs[line] = true
+		}
+	}
+	b, err = ioutil.ReadFile(f.users)
+	if err != nil {
+		return err
+	}
+	accepts, err := parseHostapdMAB(b)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.macs = macs
+	f.accepts = accepts
+	return nil
+}
+
+// parseHostapdMAB reads the reply attributes of the MAB (MD5, user is the password) hostapd users
+func parseHostapdMAB(b []byte) (map[string]radius.Attributes, error) {
+	accepts := make(map[string]radius.Attributes)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	var current radius.Attributes
+	mac := ""
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, acceptAttribute) {
+			if len(mac) == 0 {
+				continue
+			}
+			avp, err := parseAcceptAttribute(strings.TrimPrefix(text, acceptAttribute))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			current = append(current, avp)
+			accepts[mac] = current
+			continue
+		}
+		mac = ""
+		current = nil
+		fields := strings.Fields(text)
+		if len(fields) == 3 && fields[1] == "MD5" && fields[0] == fields[2] {
+			mac = NormalizeMAC(strings.Trim(fields[0], `"`))
+			if len(mac) > 0 {
+				accepts[mac] = nil
+			}
+		}
+	}
+	return accepts, scanner.Err()
+}
+
+// parseAcceptAttribute parses a hostapd reply attribute (type:syntax:value, syntax is s, d, or x)
+func parseAcceptAttribute(setting string) (*radius.AVP, error) {
+	parts := strings.SplitN(setting, ":", 3)
+	t, err := strconv.Atoi(parts[0])
+	if err != nil || t <= 0 || t > 255 {
+		return nil, fmt.Errorf("invalid attribute type: %s", parts[0])
+	}
+	avp := &radius.AVP{Type: radius.Type(t)}
+	if len(parts) < 3 {
+		avp.Attribute = radius.Attribute{}
+		return avp, nil
+	}
+	switch parts[1] {
+	case "s":
+		avp.Attribute = radius.Attribute(parts[2])
+	case "d":
+		i, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer: %s", parts[2])
+		}
+		avp.Attribute = radius.NewInteger(uint32(i))
+	case "x":
+		h, err := hex.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex: %s", parts[2])
+		}
+		avp.Attribute = radius.Attribute(h)
+	default:
+		return nil, fmt.Errorf("unknown attribute syntax: %s", parts[1])
+	}
+	return avp, nil
+}
+
+// NormalizeMAC normalizes a MAC (any case/separators) to 12 lowercase hex characters (empty if it is not a MAC)
+func NormalizeMAC(in string) string {
+	result := ""
+	for _, c := range strings.ToLower(in) {
+		switch {
+		case (c >= 'a' && c <= 'f') || (c >= '0' && c <= '9'):
+			result = result + string(c)
+		case c == '-' || c == ':' || c == '.':
+		default:
+			return ""
+		}
+	}
+	if len(result) != 12 {
+		return ""
+	}
+	return result
+}
+
+// isMAB indicates if a request is MAC authentication bypass (no EAP, the user name and calling station are the MAC)
+func isMAB(p *radius.Packet) (string, bool) {
+	if p.Code != radius.CodeAccessRequest {
+		return "", false
+	}
+	if _, ok := p.Lookup(rfc2869.EAPMessage_Type); ok {
+		return "", false
+	}
+	mac := NormalizeMAC(rfc2865.UserName_GetString(p))
+	if len(mac) == 0 || NormalizeMAC(rfc2865.CallingStationID_GetString(p)) != mac {
+		return "", false
+	}
+	return mac, true
+}
+
+// Handle answers a MAB request while the upstreams are down, returning false when the request should be relayed
+func (f *MABFallback) Handle(b []byte, addr *net.UDPAddr, write writeBack) bool {
+	if f == nil || f.upstreams.Healthy() {
+		return false
+	}
+	packet, err := radius.Parse(b, nil)
+	if err != nil {
+		return false
+	}
+	if _, ok := isMAB(packet); !ok {
+		return false
+	}
+	secret := f.ctx.clientSecret(addr)
+	if err := verifyRequest(b, secret, f.ctx.requiresAuthenticator()); err != nil {
+		core.WriteError("invalid MAB request", err)
+		fallbackMetric.Inc(badAuthCode.String())
+		return true
+	}
+	packet, err = radius.Parse(b, secret)
+	if err != nil {
+		return true
+	}
+	mac, _ := isMAB(packet)
+	resp := f.answer(packet, mac)
+	if resp == nil {
+		return true
+	}
+	rfc2869.MessageAuthenticator_Set(resp, make([]byte, 16))
+	encoded, err := EncodePacket(resp)
+	if err != nil {
+		core.WriteError("unable to encode MAB response", err)
+		return true
+	}
+	write(encoded)
+	return true
+}
+
+func (f *MABFallback) answer(packet *radius.Packet, mac string) *radius.Packet {
+	accepted := NormalizeMAC(rfc2865.UserPassword_GetString(packet)) == mac
+	var attributes radius.Attributes
+	if accepted {
+		f.lock.RLock()
+		var ok bool
+		attributes, ok = f.accepts[mac]
+		accepted = ok && f.macs[core.NewManifestEntry(mac, mac)]
+		f.lock.RUnlock()
+	}
+	if f.ctx.Debug {
+		core.WriteDebug("MAB answered locally", mac, fmt.Sprintf("%t", accepted))
+	}
+	if !accepted {
+		fallbackMetric.Inc("reject")
+		f.ctx.lock.RLock()
+		noReject := f.ctx.noReject
+		f.ctx.lock.RUnlock()
+		if noReject {
+			return nil
+		}
+		return packet.Response(radius.CodeAccessReject)
+	}
+	fallbackMetric.Inc("accept")
+	resp := packet.Response(radius.CodeAccessAccept)
+	for _, avp := range attributes {
+		resp.Add(avp.Type, avp.Attribute)
+	}
+	return resp
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc2869"
+	"layeh.com/radius/rfc3580"
+	"voidedtech.com/radiucal/internal/authem"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+func TestParseHostapdMAB(t *testing.T) {
+	users := strings.Join([]string{
+		authem.UserAddRADIUS("user", "abc", 10),
+		authem.MACAddRADIUS("aabbccddeeff", 20),
+		authem.MACAddRADIUS("112233445566", 30),
+	}, "\n\n")
+	accepts, err := parseHostapdMAB([]byte(users))
+	if err != nil {
+		t.Fatal("unable to parse", err)
+	}
+	if len(accepts) != 2 {
+		t.Error("only MAB users", accepts)
+	}
+	p := radius.New(radius.CodeAccessAccept, []byte("secret"))
+	p.Attributes = accepts["aabbccddeeff"]
+	if _, vlan := rfc2868.TunnelPrivateGroupID_GetString(p); vlan != "20" {
+		t.Error("invalid vlan")
+	}
+	if _, tunnel := rfc2868.TunnelType_Get(p); tunnel != rfc3580.TunnelType_Value_VLAN {
+		t.Error("invalid tunnel type")
+	}
+	if _, err := parseHostapdMAB([]byte("\"112233445566\" MD5 \"112233445566\"\nradius_accept_attr=64:q:1")); err == nil || err.Error() != "line 2: unknown attribute syntax: q" {
+		t.Error("invalid syntax", err)
+	}
+	avp, err := parseAcceptAttribute("25:x:0a0b")
+	if err != nil || avp.Type != 25 || string(avp.Attribute) != "\x0a\x0b" {
+		t.Error("hex attribute")
+	}
+	if _, err := parseAcceptAttribute("0:s:a"); err == nil {
+		t.Error("invalid type")
+	}
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	for in, out := range map[string]string{
+		"AA-BB-CC-DD-EE-FF": "aabbccddeeff",
+		"aa:bb:cc:dd:ee:ff": "aabbccddeeff",
+		"aabb.ccdd.eeff":    "aabbccddeeff",
+		"aabbccddeeff":      "aabbccddeeff",
+		"aabbccddee":        "",
+		"user":              "",
+	} {
+		if NormalizeMAC(in) != out {
+			t.Error("invalid MAC", in)
+		}
+	}
+}
+
+func newMABRequest(t *testing.T, secret []byte, user, password string, eap bool) []byte {
+	p := radius.New(radius.CodeAccessRequest, secret)
+	rfc2865.UserName_SetString(p, user)
+	rfc2865.CallingStationID_SetString(p, user)
+	if len(password) > 0 {
+		// NAS padding (to 16 bytes) of the password
+		padded := make([]byte, (len(password)+15)/16*16)
+		copy(padded, password)
+		rfc2865.UserPassword_Set(p, padded)
+	}
+	if eap {
+		rfc2869.EAPMessage_Set(p, []byte{2, 0, 0, 5, 1})
+	}
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, err := EncodePacket(p)
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	return b
+}
+
+func TestMABFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal("unable to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	manifest := filepath.Join(dir, "manifest")
+	users := filepath.Join(dir, "eap_users")
+	ioutil.WriteFile(manifest, []byte(core.NewManifestEntry("aabbccddeeff", "aabbccddeeff")+"\nuser.112233445566"), 0644)
+	ioutil.WriteFile(users, []byte(authem.MACAddRADIUS("aabbccddeeff", 20)+"\n\n"+authem.MACAddRADIUS("112233445566", 30)), 0644)
+	ctx := &Context{secret: []byte("secret")}
+	pool := newTestPool(t, FailoverSelect)
+	if _, err := NewMABFallback(ctx, pool, filepath.Join(dir, "missing"), users); err == nil {
+		t.Error("missing manifest")
+	}
+	f, err := NewMABFallback(ctx, pool, manifest, users)
+	if err != nil {
+		t.Fatal("unable to load", err)
+	}
+	var written [][]byte
+	write := func(b []byte) {
+		written = append(written, b)
+	}
+	mab := newMABRequest(t, ctx.secret, "AA-BB-CC-DD-EE-FF", "aabbccddeeff", false)
+	if f.Handle(mab, nil, write) || len(written) != 0 {
+		t.Error("upstreams are healthy")
+	}
+	for _, u := range pool.upstreams {
+		u.down = time.Now().Add(time.Minute)
+	}
+	if !f.Handle(mab, nil, write) || len(written) != 1 {
+		t.Fatal("MAB should be answered")
+	}
+	resp, err := radius.Parse(written[0], ctx.secret)
+	if err != nil || resp.Code != radius.CodeAccessAccept || !radius.IsAuthenticResponse(written[0], mab, ctx.secret) {
+		t.Fatal("invalid accept")
+	}
+	if _, vlan := rfc2868.TunnelPrivateGroupID_GetString(resp); vlan != "20" {
+		t.Error("accept should carry the vlan")
+	}
+	if f.Handle(newMABRequest(t, ctx.secret, "user", "password12345678", true), nil, write) {
+		t.Error("PEAP should be relayed")
+	}
+	if !f.Handle(newMABRequest(t, []byte("other"), "aabbccddeeff", "aabbccddeeff", false), nil, write) || len(written) != 1 {
+		t.Error("invalid request should be dropped")
+	}
+	for _, req := range [][]byte{
+		newMABRequest(t, ctx.secret, "aabbccddeeff", "password12345678", false),
+		newMABRequest(t, ctx.secret, "112233445566", "112233445566", false),
+		newMABRequest(t, ctx.secret, "010203040506", "010203040506", false),
+	} {
+		count := len(written)
+		if !f.Handle(req, nil, write) || len(written) != count+1 || radius.Code(written[count][0]) != radius.CodeAccessReject {
+			t.Error("MAB should be rejected")
+		}
+	}
+	ctx.noReject = true
+	if !f.Handle(newMABRequest(t, ctx.secret, "010203040506", "010203040506", false), nil, write) || len(written) != 4 {
+		t.Error("no reject")
+	}
+	var missing *MABFallback
+	if missing.Handle(mab, nil, write) {
+		t.Error("no fallback")
+	}
+}
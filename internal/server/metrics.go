@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterMetric   metricType = "counter"
+	gaugeMetric     metricType = "gauge"
+	histogramMetric metricType = "histogram"
+	labelSeparator             = "\xff"
+)
+
+var (
+	metrics = NewMetricRegistry()
+	// DefaultBuckets are histogram buckets (in seconds) suited to radius response times
+	DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// server metrics
+	receivedMetric = newCounter("radiucal_packets_received_total", "Packets received from clients by code", "code")
+	nasMetric      = newCounter("radiucal_nas_packets_total", "Packets received from clients by NAS address", "nas")
+	authMetric     = newCounter("radiucal_authorizations_total", "Authorization outcomes by stage and reason", "stage", "reason")
+	rejectMetric   = newCounter("radiucal_rejects_total", "Access-Rejects sent to clients")
+	parseMetric    = newCounter("radiucal_parse_failures_total", "Packets that could not be parsed")
+	latencyMetric  = newHistogram("radiucal_upstream_latency_seconds", "Upstream response latency", "upstream")
+)
+
+type (
+	metricType string
+
+	series struct {
+		labels  []string
+		value   float64
+		buckets []uint64
+		count   uint64
+	}
+
+	metric struct {
+		lock    *sync.Mutex
+		name    string
+		help    string
+		kind    metricType
+		labels  []string
+		buckets []float64
+		series  map[string]*series
+		sample  func() float64
+	}
+
+	// Counter is a metric that only increases
+	Counter struct {
+		m *metric
+	}
+
+	// Gauge is a metric that can be set to any value
+	Gauge struct {
+		m *metric
+	}
+
+	// Histogram is a metric that observes values into buckets
+	Histogram struct {
+		m *metric
+	}
+
+	// MetricRegistry holds metrics for exposition (prometheus text format), only counters, gauges, and histograms are
+	// needed so they are written here instead of adding the prometheus client (and with it protobuf, procfs, and x/sys)
+	// to the proxy's dependencies
+	MetricRegistry struct {
+		lock    *sync.Mutex
+		metrics map[string]*metric
+	}
+)
+
+// NewMetricRegistry creates an empty metric registry
+func NewMetricRegistry() *MetricRegistry {
+	return &MetricRegistry{lock: &sync.Mutex{}, metrics: make(map[string]*metric)}
+}
+
+// DefaultMetrics is the registry used by the server and plugins
+func DefaultMetrics() *MetricRegistry {
+	return metrics
+}
+
+func (r *MetricRegistry) register(name, help string, kind metricType, buckets []float64, labels []string) (*metric, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("metric name required")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		if m.kind != kind || strings.Join(m.labels, labelSeparator) != strings.Join(labels, labelSeparator) {
+			return nil, fmt.Errorf("metric %s already registered differently", name)
+		}
+		return m, nil
+	}
+	m := &metric{
+		lock:    &sync.Mutex{},
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.metrics[name] = m
+	return m, nil
+}
+
+// NewCounter registers (or retrieves an identical) counter
+func (r *MetricRegistry) NewCounter(name, help string, labels ...string) (*Counter, error) {
+	m, err := r.register(name, help, counterMetric, nil, labels)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{m: m}, nil
+}
+
+// NewGauge registers (or retrieves an identical) gauge
+func (r *MetricRegistry) NewGauge(name, help string, labels ...string) (*Gauge, error) {
+	m, err := r.register(name, help, gaugeMetric, nil, labels)
+	if err != nil {
+		return nil, err
+	}
+	return &Gauge{m: m}, nil
+}
+
+// NewGaugeFunc registers a gauge which is sampled when collected (replacing any prior sampler)
+func (r *MetricRegistry) NewGaugeFunc(name, help string, sample func() float64) error {
+	m, err := r.register(name, help, gaugeMetric, nil, nil)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sample = sample
+	return nil
+}
+
+// NewHistogram registers (or retrieves an identical) histogram, using default buckets if none given
+func (r *MetricRegistry) NewHistogram(name, help string, buckets []float64, labels ...string) (*Histogram, error) {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return nil, fmt.Errorf("histogram buckets must be increasing")
+		}
+	}
+	m, err := r.register(name, help, histogramMetric, buckets, labels)
+	if err != nil {
+		return nil, err
+	}
+	return &Histogram{m: m}, nil
+}
+
+func mustMetric(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newCounter(name, help string, labels ...string) *Counter {
+	c, err := metrics.NewCounter(name, help, labels...)
+	mustMetric(err)
+	return c
+}
+
+func newHistogram(name, help string, labels ...string) *Histogram {
+	h, err := metrics.NewHistogram(name, help, nil, labels...)
+	mustMetric(err)
+	return h
+}
+
+func init() {
+	mustMetric(metrics.NewGaugeFunc("radiucal_plugin_log_queue", "Plugin messages waiting to be written", func() float64 {
+		pluginLock.Lock()
+		defer pluginLock.Unlock()
+		return float64(len(pluginLogs))
+	}))
+}
+
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values", m.name, len(m.labels)))
+	}
+	key := strings.Join(values, labelSeparator)
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		if m.kind == histogramMetric {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increases the counter (negative values are ignored)
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	c.m.get(values).value += v
+}
+
+// Set sets the gauge value
+func (g *Gauge) Set(v float64, values ...string) {
+	g.m.lock.Lock()
+	defer g.m.lock.Unlock()
+	g.m.get(values).value = v
+}
+
+// Add adds to (or subtracts from) the gauge value
+func (g *Gauge) Add(v float64, values ...string) {
+	g.m.lock.Lock()
+	defer g.m.lock.Unlock()
+	g.m.get(values).value += v
+}
+
+// Observe records a value in the histogram
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.m.lock.Lock()
+	defer h.m.lock.Unlock()
+	s := h.m.get(values)
+	for i, b := range h.m.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, n, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, strings.Replace(m.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	if m.sample != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.sample()))
+		return
+	}
+	var keys []string
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != histogramMetric {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels), formatValue(s.value))
+			continue
+		}
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", formatValue(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labels), s.count)
+	}
+}
+
+// Write outputs all metrics in the prometheus text format
+func (r *MetricRegistry) Write(w io.Writer) {
+	r.lock.Lock()
+	var names []string
+	for n := range r.metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var ordered []*metric
+	for _, n := range names {
+		ordered = append(ordered, r.metrics[n])
+	}
+	r.lock.Unlock()
+	for _, m := range ordered {
+		m.write(w)
+	}
+}
+
+// ServeHTTP serves the metrics for scraping
+func (r *MetricRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var b bytes.Buffer
+	r.Write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
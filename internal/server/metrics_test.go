@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func metricOutput(r *MetricRegistry) string {
+	var b bytes.Buffer
+	r.Write(&b)
+	return b.String()
+}
+
+func TestMetricRegistration(t *testing.T) {
+	r := NewMetricRegistry()
+	c, err := r.NewCounter("test_total", "test", "a")
+	if err != nil {
+		t.Error("should register")
+	}
+	o, err := r.NewCounter("test_total", "test", "a")
+	if err != nil || o.m != c.m {
+		t.Error("should reuse identical metric")
+	}
+	if _, err := r.NewCounter("test_total", "test", "b"); err == nil {
+		t.Error("labels differ")
+	}
+	if _, err := r.NewGauge("test_total", "test", "a"); err == nil {
+		t.Error("types differ")
+	}
+	if _, err := r.NewCounter("", "test"); err == nil {
+		t.Error("name required")
+	}
+	if _, err := r.NewHistogram("hist", "test", []float64{1, 1}); err == nil {
+		t.Error("invalid buckets")
+	}
+}
+
+func TestMetricOutput(t *testing.T) {
+	r := NewMetricRegistry()
+	c, _ := r.NewCounter("b_total", "counts\nthings", "code")
+	c.Inc("Access-Request")
+	c.Add(2, "Access-Request")
+	c.Add(-1, "Access-Request")
+	c.Inc(`a"b`)
+	g, _ := r.NewGauge("c_gauge", "gauge")
+	g.Set(5)
+	g.Add(-2)
+	r.NewGaugeFunc("a_sample", "sampled", func() float64 { return 1.5 })
+	h, _ := r.NewHistogram("d_seconds", "latency", []float64{0.1, 1}, "upstream")
+	h.Observe(0.05, "x")
+	h.Observe(0.5, "x")
+	h.Observe(5, "x")
+	expect := `# HELP a_sample sampled
+# TYPE a_sample gauge
+a_sample 1.5
+# HELP b_total counts things
+# TYPE b_total counter
+b_total{code="Access-Request"} 3
+b_total{code="a\"b"} 1
+# HELP c_gauge gauge
+# TYPE c_gauge gauge
+c_gauge 3
+# HELP d_seconds latency
+# TYPE d_seconds histogram
+d_seconds_bucket{upstream="x",le="0.1"} 1
+d_seconds_bucket{upstream="x",le="1"} 2
+d_seconds_bucket{upstream="x",le="+Inf"} 3
+d_seconds_sum{upstream="x"} 5.55
+d_seconds_count{upstream="x"} 3
+`
+	if actual := metricOutput(r); actual != expect {
+		t.Errorf("invalid output:\n%s", actual)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Body.String() != expect || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Error("invalid http output")
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	ctx, p := getPacket(t)
+	ctx.authorize(p, preMode)
+	ctx.authorize(NewClientPacket([]byte{1}, nil), preMode)
+	out := metricOutput(DefaultMetrics())
+	for _, m := range []string{
+		`radiucal_packets_received_total{code="Access-Request"}`,
+		`radiucal_authorizations_total{stage="pre",reason="success"}`,
+		"radiucal_parse_failures_total",
+		"radiucal_plugin_log_queue",
+	} {
+		if !strings.Contains(out, m) {
+			t.Error("missing metric", m)
+		}
+	}
+	if NewPluginContext(&Configuration{}).Metrics() != DefaultMetrics() {
+		t.Error("plugins should use the default registry")
+	}
+}
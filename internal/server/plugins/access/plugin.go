@@ -3,49 +3,84 @@ package access
 import (
 	"fmt"
 	"strconv"
+	"sync"
 
 	"layeh.com/radius/rfc2865"
 	"voidedtech.com/radiucal/internal/server"
 )
 
-var (
-	// Plugin represents the plugin instance for the system
-	Plugin access
-	modes  []string
+const (
+	name = "access"
 )
 
 type (
-	access struct{}
+	access struct {
+		name    string
+		lock    *sync.RWMutex
+		modes   []string
+		pending *sync.WaitGroup
+	}
 )
 
+// New creates an access plugin instance
+func New() server.Module {
+	return &access{name: name, lock: &sync.RWMutex{}, pending: &sync.WaitGroup{}}
+}
+
 func (l *access) Name() string {
-	return "access"
+	return l.name
 }
 
 func (l *access) Setup(ctx *server.PluginContext) error {
-	modes = server.DisabledModes(l, ctx)
+	l.name = ctx.InstanceName(name)
+	return l.Reload(ctx)
+}
+
+func (l *access) Reload(ctx *server.PluginContext) error {
+	// no options are supported
+	if err := ctx.Options(&struct{}{}); err != nil {
+		return err
+	}
+	modes := server.DisabledModes(l, ctx)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.modes = modes
+	return nil
+}
+
+func (l *access) Teardown() error {
+	l.pending.Wait()
 	return nil
 }
 
 func (l *access) Pre(packet *server.ClientPacket) bool {
-	return server.NoopPre(packet, write)
+	return server.NoopPre(packet, l.write)
 }
 
 func (l *access) Post(packet *server.ClientPacket) bool {
-	return server.NoopPost(packet, write)
+	return server.NoopPost(packet, l.write)
 }
 
 func (l *access) Trace(t server.TraceType, packet *server.ClientPacket) {
-	write(server.TracingMode, t, packet)
+	l.write(server.TraceMode(t), t, packet)
+}
+
+func (l *access) Account(packet *server.ClientPacket) bool {
+	l.write(server.AccountingMode, server.NoTrace, packet)
+	return true
 }
 
-func (l *access) Account(packet *server.ClientPacket) {
-	write(server.AccountingMode, server.NoTrace, packet)
+func (l *access) disabled(mode string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return server.Disabled(mode, l.modes)
 }
 
-func write(mode string, objType server.TraceType, packet *server.ClientPacket) {
+func (l *access) write(mode string, objType server.TraceType, packet *server.ClientPacket) {
+	l.pending.Add(1)
 	go func() {
-		if server.Disabled(mode, modes) {
+		defer l.pending.Done()
+		if l.disabled(mode) {
 			return
 		}
 		username, err := rfc2865.UserName_LookupString(packet.Packet)
@@ -63,6 +98,6 @@ func write(mode string, objType server.TraceType, packet *server.ClientPacket) {
 		kv.Add("Id", strconv.Itoa(int(packet.Packet.Identifier)))
 		kv.Add("User-Name", username)
 		kv.Add("Calling-Station-Id", calling)
-		server.LogPluginMessages(&Plugin, kv.Strings())
+		server.LogPluginMessages(l, kv.Strings())
 	}()
 }
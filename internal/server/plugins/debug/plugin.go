@@ -5,13 +5,22 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 	"time"
 
 	"voidedtech.com/radiucal/internal/server"
 )
 
+const (
+	name = "debugger"
+)
+
 type (
 	tracer struct {
+		name    string
+		lock    *sync.RWMutex
+		modes   []string
+		pending *sync.WaitGroup
 	}
 
 	logTrace struct {
@@ -20,35 +29,58 @@ type (
 	}
 )
 
-var (
-	// Plugin represents the system instance of the module
-	Plugin tracer
-	modes  []string
-)
+// New creates a debug plugin instance
+func New() server.Module {
+	return &tracer{name: name, lock: &sync.RWMutex{}, pending: &sync.WaitGroup{}}
+}
 
 func (t *tracer) Name() string {
-	return "debugger"
+	return t.name
 }
 
 func (t *tracer) Setup(ctx *server.PluginContext) error {
-	modes = server.DisabledModes(t, ctx)
+	t.name = ctx.InstanceName(name)
+	return t.Reload(ctx)
+}
+
+func (t *tracer) Reload(ctx *server.PluginContext) error {
+	// no options are supported
+	if err := ctx.Options(&struct{}{}); err != nil {
+		return err
+	}
+	modes := server.DisabledModes(t, ctx)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.modes = modes
+	return nil
+}
+
+func (t *tracer) Teardown() error {
+	t.pending.Wait()
 	return nil
 }
 
 func (t *tracer) Pre(packet *server.ClientPacket) bool {
-	return server.NoopPre(packet, dump)
+	return server.NoopPre(packet, t.dump)
 }
 
 func (t *tracer) Post(packet *server.ClientPacket) bool {
-	return server.NoopPost(packet, dump)
+	return server.NoopPost(packet, t.dump)
 }
 
 func (t *tracer) Trace(objType server.TraceType, packet *server.ClientPacket) {
-	dump(server.TracingMode, objType, packet)
+	t.dump(server.TraceMode(objType), objType, packet)
+}
+
+func (t *tracer) Account(packet *server.ClientPacket) bool {
+	t.dump(server.AccountingMode, server.NoTrace, packet)
+	return true
 }
 
-func (t *tracer) Account(packet *server.ClientPacket) {
-	dump(server.AccountingMode, server.NoTrace, packet)
+func (t *tracer) disabled(mode string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return server.Disabled(mode, t.modes)
 }
 
 func (t *logTrace) Write(b []byte) (int, error) {
@@ -59,14 +91,16 @@ func (t *logTrace) dump() {
 	log.Println(t.data.String())
 }
 
-func dump(mode string, objType server.TraceType, packet *server.ClientPacket) {
+func (t *tracer) dump(mode string, objType server.TraceType, packet *server.ClientPacket) {
+	t.pending.Add(1)
 	go func() {
-		if server.Disabled(mode, modes) {
+		defer t.pending.Done()
+		if t.disabled(mode) {
 			return
 		}
-		t := &logTrace{}
-		write(t, mode, objType, packet, time.Now())
-		t.dump()
+		l := &logTrace{}
+		write(l, mode, objType, packet, time.Now())
+		l.dump()
 	}()
 }
 
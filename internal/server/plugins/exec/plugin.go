@@ -0,0 +1,414 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/core"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+const (
+	name = "exec"
+	// maximum size of a helper's response line
+	maxLine = 64 * 1024
+	// how long to wait for the helper to exit when stopping before it is killed
+	stopWait = 5 * time.Second
+)
+
+type (
+	external struct {
+		name    string
+		lock    *sync.RWMutex
+		opts    options
+		modes   []string
+		dict    *server.Dictionary
+		helper  *helper
+		results *server.Counter
+	}
+
+	options struct {
+		// Command is the helper to run (and Args its arguments)
+		Command string
+		Args    []string
+		// Timeout is how long (seconds) to wait for a decision
+		Timeout int
+		// Restart is the minimum time (seconds) between starts of the helper
+		Restart int
+		// FailOpen accepts packets when the helper does not decide (timeout, not running)
+		FailOpen bool
+	}
+
+	// request is written (one JSON object per line) to the helper for each packet
+	request struct {
+		ID         uint64              `json:"id"`
+		Mode       string              `json:"mode"`
+		Client     string              `json:"client,omitempty"`
+		Code       string              `json:"code"`
+		Identifier int                 `json:"identifier"`
+		Attributes map[string][]string `json:"attributes"`
+	}
+
+	// response is read (one JSON object per line) from the helper, answering the request of the same id
+	response struct {
+		ID      uint64 `json:"id"`
+		Accept  bool   `json:"accept"`
+		Message string `json:"message,omitempty"`
+	}
+
+	// line is a request written to the helper
+	line struct {
+		id uint64
+		b  []byte
+	}
+
+	helper struct {
+		lock    *sync.Mutex
+		command string
+		args    []string
+		restart time.Duration
+		drain   time.Duration
+		cmd     *exec.Cmd
+		stdin   io.WriteCloser
+		writes  chan line
+		done    chan struct{}
+		idle    chan struct{}
+		waiting map[uint64]chan *response
+		next    uint64
+		started time.Time
+		stopped bool
+	}
+)
+
+// New creates an exec plugin instance
+func New() server.Module {
+	return newExternal()
+}
+
+func newExternal() *external {
+	return &external{name: name, lock: &sync.RWMutex{}}
+}
+
+func newHelper(opts options) *helper {
+	return &helper{
+		lock:    &sync.Mutex{},
+		command: opts.Command,
+		args:    opts.Args,
+		restart: time.Duration(opts.Restart) * time.Second,
+		drain:   time.Duration(opts.Timeout) * time.Second,
+		waiting: make(map[uint64]chan *response),
+	}
+}
+
+func (e *external) Name() string {
+	return e.name
+}
+
+func (e *external) Setup(ctx *server.PluginContext) error {
+	counter, err := ctx.Metrics().NewCounter("radiucal_exec_total", "Helper decisions by result", "result", "instance")
+	if err != nil {
+		return err
+	}
+	e.results = counter
+	e.name = ctx.InstanceName(name)
+	return e.Reload(ctx)
+}
+
+// Reload restarts the helper (so it can re-read its policy), the previous helper answers its outstanding requests
+// first
+func (e *external) Reload(ctx *server.PluginContext) error {
+	opts := options{}
+	if err := ctx.Options(&opts); err != nil {
+		return err
+	}
+	if len(opts.Command) == 0 {
+		return fmt.Errorf("exec requires a command")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2
+	}
+	if opts.Restart <= 0 {
+		opts.Restart = 1
+	}
+	modes := server.DisabledModes(e, ctx)
+	h := newHelper(opts)
+	err := h.start()
+	e.lock.Lock()
+	previous := e.helper
+	e.opts = opts
+	e.modes = modes
+	e.dict = ctx.Dictionary()
+	e.helper = h
+	e.lock.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+	return err
+}
+
+func (e *external) Teardown() error {
+	e.lock.RLock()
+	h := e.helper
+	e.lock.RUnlock()
+	if h != nil {
+		h.stop()
+	}
+	return nil
+}
+
+func (e *external) Pre(packet *server.ClientPacket) bool {
+	return e.decide(server.PreAuthMode, packet)
+}
+
+func (e *external) Post(packet *server.ClientPacket) bool {
+	return e.decide(server.PostAuthMode, packet)
+}
+
+func (e *external) Account(packet *server.ClientPacket) bool {
+	return e.decide(server.AccountingMode, packet)
+}
+
+// decide asks the helper to accept (or reject) a packet
+func (e *external) decide(mode string, packet *server.ClientPacket) bool {
+	e.lock.RLock()
+	opts := e.opts
+	h := e.helper
+	dict := e.dict
+	disabled := server.Disabled(mode, e.modes)
+	e.lock.RUnlock()
+	if disabled || packet.Packet == nil || h == nil {
+		return true
+	}
+	req := &request{
+		Mode:       mode,
+		Code:       packet.Packet.Code.String(),
+		Identifier: int(packet.Packet.Identifier),
+		Attributes: dict.Values(packet.Packet),
+	}
+	if packet.ClientAddr != nil {
+		req.Client = packet.ClientAddr.String()
+	}
+	resp, err := h.call(req, time.Duration(opts.Timeout)*time.Second)
+	if err != nil {
+		core.WriteWarn(fmt.Sprintf("exec helper failed: %s (%v)", e.Name(), err))
+		e.results.Inc("error", e.Name())
+		return opts.FailOpen
+	}
+	if resp.Accept {
+		e.results.Inc("accept", e.Name())
+		return true
+	}
+	e.results.Inc("reject", e.Name())
+	kv := server.KeyValueStore{}
+	kv.DropEmpty = true
+	kv.Add("Result", "REJECT")
+	kv.Add("Mode", mode)
+	kv.Add("User-Name", rfc2865.UserName_GetString(packet.Packet))
+	kv.Add("Calling-Station-Id", rfc2865.CallingStationID_GetString(packet.Packet))
+	kv.Add("Id", strconv.Itoa(int(packet.Packet.Identifier)))
+	kv.Add("Message", resp.Message)
+	server.LogPluginMessages(e, kv.Strings())
+	return false
+}
+
+// start runs the helper (not more often than the restart time), the caller must hold the lock unless the helper is
+// not yet shared
+func (h *helper) start() error {
+	if h.stopped {
+		return fmt.Errorf("helper stopped")
+	}
+	if time.Since(h.started) < h.restart {
+		return fmt.Errorf("helper restarting")
+	}
+	h.started = time.Now()
+	cmd := exec.Command(h.command, h.args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	h.cmd = cmd
+	h.stdin = stdin
+	h.writes = make(chan line)
+	h.done = make(chan struct{})
+	go h.read(cmd, stdout, h.done)
+	go h.write(stdin, h.writes, h.done)
+	return nil
+}
+
+// write writes the requests to the helper until it exits (a helper not reading its input only blocks this writer)
+func (h *helper) write(stdin io.Writer, writes chan line, done chan struct{}) {
+	for {
+		select {
+		case l := <-writes:
+			if _, err := stdin.Write(l.b); err != nil {
+				core.WriteWarn(fmt.Sprintf("unable to write to exec helper: %v", err))
+				h.lock.Lock()
+				h.end(l.id)
+				h.lock.Unlock()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// read delivers the helper's responses until it exits
+func (h *helper) read(cmd *exec.Cmd, stdout io.Reader, done chan struct{}) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 4096), maxLine)
+	for scanner.Scan() {
+		resp := &response{}
+		if err := json.Unmarshal(scanner.Bytes(), resp); err != nil {
+			core.WriteWarn(fmt.Sprintf("invalid exec helper response: %v", err))
+			continue
+		}
+		h.lock.Lock()
+		if c, ok := h.waiting[resp.ID]; ok {
+			c <- resp
+			h.release(resp.ID)
+		}
+		h.lock.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		core.WriteWarn(fmt.Sprintf("unable to read exec helper: %v", err))
+		cmd.Process.Kill()
+	}
+	err := cmd.Wait()
+	h.lock.Lock()
+	if h.cmd == cmd {
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		core.WriteWarn(fmt.Sprintf("exec helper ended: %s (%v)", h.command, err))
+		h.cmd = nil
+		h.fail()
+	}
+	h.lock.Unlock()
+	close(done)
+}
+
+// fail ends the waiting calls (the lock must be held)
+func (h *helper) fail() {
+	for id := range h.waiting {
+		h.end(id)
+	}
+}
+
+// end ends a waiting call without a response (the lock must be held)
+func (h *helper) end(id uint64) {
+	if c, ok := h.waiting[id]; ok {
+		close(c)
+		h.release(id)
+	}
+}
+
+// release removes a call that is no longer waiting, signaling a stopping helper once none are (the lock must be held)
+func (h *helper) release(id uint64) {
+	delete(h.waiting, id)
+	if h.idle != nil && len(h.waiting) == 0 {
+		close(h.idle)
+		h.idle = nil
+	}
+}
+
+// call writes a request and waits (up to the timeout) for the response, restarting the helper if it is not running
+func (h *helper) call(req *request, timeout time.Duration) (*response, error) {
+	c := make(chan *response, 1)
+	h.lock.Lock()
+	if h.cmd == nil {
+		if err := h.start(); err != nil {
+			h.lock.Unlock()
+			return nil, err
+		}
+	}
+	h.next++
+	req.ID = h.next
+	b, err := json.Marshal(req)
+	if err != nil {
+		h.lock.Unlock()
+		return nil, err
+	}
+	h.waiting[req.ID] = c
+	writes := h.writes
+	done := h.done
+	h.lock.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case writes <- line{id: req.ID, b: append(b, '\n')}:
+	case <-done:
+		h.forget(req.ID)
+		return nil, fmt.Errorf("helper exited")
+	case <-timer.C:
+		h.forget(req.ID)
+		return nil, fmt.Errorf("helper timed out")
+	}
+	select {
+	case resp, ok := <-c:
+		if !ok {
+			return nil, fmt.Errorf("helper exited")
+		}
+		return resp, nil
+	case <-timer.C:
+		h.forget(req.ID)
+		return nil, fmt.Errorf("helper timed out")
+	}
+}
+
+func (h *helper) forget(id uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.release(id)
+}
+
+// stop waits (up to the timeout) for the outstanding requests, closes the helper's input (it should exit), and kills
+// it if it has not exited in time
+func (h *helper) stop() {
+	h.lock.Lock()
+	cmd := h.cmd
+	done := h.done
+	h.stopped = true
+	var idle chan struct{}
+	if cmd != nil && len(h.waiting) > 0 {
+		idle = make(chan struct{})
+		h.idle = idle
+	}
+	h.lock.Unlock()
+	if cmd == nil {
+		return
+	}
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-time.After(h.drain):
+		}
+	}
+	h.lock.Lock()
+	h.cmd = nil
+	h.idle = nil
+	h.fail()
+	h.stdin.Close()
+	h.lock.Unlock()
+	select {
+	case <-done:
+	case <-time.After(stopWait):
+		cmd.Process.Kill()
+		<-done
+	}
+}
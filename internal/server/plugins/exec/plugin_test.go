@@ -0,0 +1,203 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+// TestHelperProcess is the helper (run by the tests), it accepts all users except "reject", never answers "slow",
+// answers "delayed" after a while, and exits for "crash" (given "deaf" it never reads its input)
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("RADIUCAL_EXEC_HELPER") != "1" {
+		return
+	}
+	if os.Args[len(os.Args)-1] == "deaf" {
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		req := &request{}
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			os.Exit(2)
+		}
+		user := ""
+		if users := req.Attributes["User-Name"]; len(users) > 0 {
+			user = users[0]
+		}
+		switch user {
+		case "slow":
+			continue
+		case "delayed":
+			time.Sleep(500 * time.Millisecond)
+		case "crash":
+			os.Exit(1)
+		}
+		resp := &response{ID: req.ID, Accept: user != "reject", Message: fmt.Sprintf("%s %s %s", req.Mode, req.Client, user)}
+		b, _ := json.Marshal(resp)
+		fmt.Println(string(b))
+	}
+	os.Exit(0)
+}
+
+func newTestPlugin(t *testing.T, extra map[string]interface{}) (*external, error) {
+	e := newExternal()
+	err := e.Setup(newTestContext(extra))
+	return e, err
+}
+
+func newTestContext(extra map[string]interface{}) *server.PluginContext {
+	os.Setenv("RADIUCAL_EXEC_HELPER", "1")
+	opts := map[string]interface{}{
+		"command": os.Args[0],
+		"args":    []string{"-test.run=TestHelperProcess"},
+		"timeout": 1,
+	}
+	for k, v := range extra {
+		opts[k] = v
+	}
+	ctx := server.NewPluginContext(&server.Configuration{Dir: os.TempDir()})
+	return ctx.ForPlugin(server.PluginConfig{Name: "exec", Options: opts})
+}
+
+func newPacket(user string) *server.ClientPacket {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1234")
+	p := server.NewClientPacket(nil, addr)
+	p.Packet = radius.New(radius.CodeAccessRequest, []byte("secret"))
+	rfc2865.UserName_AddString(p.Packet, user)
+	return p
+}
+
+func TestExec(t *testing.T) {
+	e, err := newTestPlugin(t, nil)
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	defer e.Teardown()
+	if e.Name() != "exec" {
+		t.Error("invalid name")
+	}
+	if !e.Pre(newPacket("user")) || !e.Post(newPacket("user")) || !e.Account(newPacket("user")) {
+		t.Error("should accept")
+	}
+	if e.Pre(newPacket("reject")) {
+		t.Error("should reject")
+	}
+	h := e.helper
+	req := &request{Mode: server.PreAuthMode, Client: "127.0.0.1:1234", Attributes: map[string][]string{"User-Name": {"user"}}}
+	resp, err := h.call(req, time.Second)
+	if err != nil || !resp.Accept || resp.ID != req.ID || resp.Message != "preauth 127.0.0.1:1234 user" {
+		t.Error("invalid response", resp, err)
+	}
+	started := time.Now()
+	if e.Pre(newPacket("slow")) {
+		t.Error("should fail closed on timeout")
+	}
+	if time.Since(started) < time.Second {
+		t.Error("should wait for the timeout")
+	}
+	if e.Pre(newPacket("crash")) {
+		t.Error("should fail closed on crash")
+	}
+	// restarted (once the restart time passed)
+	time.Sleep(time.Second)
+	if !e.Pre(newPacket("user")) {
+		t.Error("helper should restart")
+	}
+	if err := e.Teardown(); err != nil {
+		t.Error("should teardown", err)
+	}
+	if e.Pre(newPacket("user")) {
+		t.Error("helper is stopped")
+	}
+}
+
+func TestExecOptions(t *testing.T) {
+	e, err := newTestPlugin(t, map[string]interface{}{"failopen": true})
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	if !e.Pre(newPacket("slow")) {
+		t.Error("should fail open")
+	}
+	e.Teardown()
+	if _, err := newTestPlugin(t, map[string]interface{}{"command": ""}); err == nil {
+		t.Error("command is required")
+	}
+	if _, err := newTestPlugin(t, map[string]interface{}{"command": "/not/a/command"}); err == nil {
+		t.Error("command should not start")
+	}
+	if _, err := newTestPlugin(t, map[string]interface{}{"unknown": true}); err == nil {
+		t.Error("unknown options")
+	}
+}
+
+func TestExecNotReading(t *testing.T) {
+	e, err := newTestPlugin(t, map[string]interface{}{"args": []string{"-test.run=TestHelperProcess", "--", "deaf"}})
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	h := e.helper
+	defer func() {
+		h.lock.Lock()
+		h.cmd.Process.Kill()
+		h.lock.Unlock()
+		e.Teardown()
+	}()
+	// enough to fill the pipe to the helper
+	large := map[string][]string{"User-Name": {strings.Repeat("a", 256*1024)}}
+	results := make(chan error, 2)
+	started := time.Now()
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := h.call(&request{Attributes: large}, 200*time.Millisecond)
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err == nil || err.Error() != "helper timed out" {
+			t.Error("should time out", err)
+		}
+	}
+	if time.Since(started) > time.Second {
+		t.Error("calls should not wait beyond the timeout")
+	}
+	h.lock.Lock()
+	waiting := len(h.waiting)
+	h.lock.Unlock()
+	if waiting != 0 {
+		t.Error("timed out calls should not be waiting")
+	}
+}
+
+func TestExecReloadDrains(t *testing.T) {
+	e, err := newTestPlugin(t, nil)
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	defer e.Teardown()
+	result := make(chan bool)
+	go func() {
+		result <- e.Pre(newPacket("delayed"))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := e.Reload(newTestContext(nil)); err != nil {
+		t.Fatal("should reload", err)
+	}
+	if !<-result {
+		t.Error("outstanding request should be answered by the previous helper")
+	}
+	if !e.Pre(newPacket("user")) {
+		t.Error("reloaded helper should answer")
+	}
+}
@@ -3,35 +3,59 @@ package plugins
 import (
 	"fmt"
 
+	"voidedtech.com/radiucal/internal/core"
 	"voidedtech.com/radiucal/internal/server"
 	"voidedtech.com/radiucal/internal/server/plugins/access"
 	"voidedtech.com/radiucal/internal/server/plugins/debug"
+	"voidedtech.com/radiucal/internal/server/plugins/exec"
 	"voidedtech.com/radiucal/internal/server/plugins/log"
+	"voidedtech.com/radiucal/internal/server/plugins/policy"
+	"voidedtech.com/radiucal/internal/server/plugins/rewrite"
 	"voidedtech.com/radiucal/internal/server/plugins/usermac"
+	"voidedtech.com/radiucal/internal/server/plugins/webhook"
 )
 
-// LoadPlugin loads a plugin from the name and into a module object
-func LoadPlugin(name string, ctx *server.PluginContext) (server.Module, error) {
-	mod, err := getPlugin(name)
-	if err != nil {
-		return nil, err
+type (
+	// Factory creates an (independent) plugin instance
+	Factory func() server.Module
+)
+
+var (
+	factories = map[string]Factory{
+		"usermac": usermac.New,
+		"log":     log.New,
+		"debug":   debug.New,
+		"access":  access.New,
+		"rewrite": rewrite.New,
+		"exec":    exec.New,
+		"webhook": webhook.New,
+		"policy":  policy.New,
 	}
-	if err := mod.Setup(ctx.CloneContext()); err != nil {
-		return nil, err
+)
+
+// LoadPlugins loads the configured plugins (in order) into module objects
+func LoadPlugins(plugins []server.PluginConfig, ctx *server.PluginContext) ([]server.Module, error) {
+	var mods []server.Module
+	for _, p := range plugins {
+		core.WriteInfo("loading plugin", p.Instance())
+		mod, err := LoadPlugin(p, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load plugin: %s (%v)", p.Instance(), err)
+		}
+		mods = append(mods, mod)
 	}
-	return mod, nil
+	return mods, nil
 }
 
-func getPlugin(name string) (server.Module, error) {
-	switch name {
-	case "usermac":
-		return &usermac.Plugin, nil
-	case "log":
-		return &log.Plugin, nil
-	case "debug":
-		return &debug.Plugin, nil
-	case "access":
-		return &access.Plugin, nil
+// LoadPlugin creates a plugin instance from the configuration and into a module object
+func LoadPlugin(p server.PluginConfig, ctx *server.PluginContext) (server.Module, error) {
+	factory, ok := factories[p.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin type %s", p.Name)
 	}
-	return nil, fmt.Errorf("unknown plugin type %s", name)
+	mod := factory()
+	if err := mod.Setup(ctx.ForPlugin(p)); err != nil {
+		return nil, err
+	}
+	return mod, nil
 }
@@ -0,0 +1,32 @@
+package plugins
+
+import (
+	"testing"
+
+	"voidedtech.com/radiucal/internal/server"
+)
+
+func TestLoadPlugins(t *testing.T) {
+	conf := &server.Configuration{}
+	ctx := server.NewPluginContext(conf)
+	mods, err := LoadPlugins([]server.PluginConfig{{Name: "log", Alias: "first"}, {Name: "log", Alias: "second"}, {Name: "access"}}, ctx)
+	if err != nil {
+		t.Fatal("should load", err)
+	}
+	if len(mods) != 3 || mods[0] == mods[1] {
+		t.Fatal("plugins should be independent instances")
+	}
+	if mods[0].Name() != "first" || mods[1].Name() != "second" || mods[2].Name() != "access" {
+		t.Error("invalid instance names", mods[0].Name(), mods[1].Name(), mods[2].Name())
+	}
+	if _, err := LoadPlugins([]server.PluginConfig{{Name: "unknown"}}, ctx); err == nil {
+		t.Error("unknown plugin should fail")
+	}
+	if _, err := LoadPlugin(server.PluginConfig{Name: "debug", Options: map[string]interface{}{"unknown": true}}, ctx); err == nil {
+		t.Error("invalid options should fail")
+	}
+	m, err := LoadPlugin(server.PluginConfig{Name: "debug"}, ctx)
+	if err != nil || m.Name() != "debugger" {
+		t.Error("should load with the plugin name", err)
+	}
+}
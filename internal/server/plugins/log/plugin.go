@@ -2,53 +2,87 @@ package log
 
 import (
 	"fmt"
+	"sync"
 
 	"voidedtech.com/radiucal/internal/server"
 )
 
-var (
-	// Plugin represents the system instance of the module
-	Plugin logger
-	modes  []string
+const (
+	name = "logger"
 )
 
 type (
 	logger struct {
+		name    string
+		lock    *sync.RWMutex
+		modes   []string
+		pending *sync.WaitGroup
 	}
 )
 
+// New creates a log plugin instance
+func New() server.Module {
+	return &logger{name: name, lock: &sync.RWMutex{}, pending: &sync.WaitGroup{}}
+}
+
 func (l *logger) Name() string {
-	return "logger"
+	return l.name
 }
 
 func (l *logger) Setup(ctx *server.PluginContext) error {
-	modes = server.DisabledModes(l, ctx)
+	l.name = ctx.InstanceName(name)
+	return l.Reload(ctx)
+}
+
+func (l *logger) Reload(ctx *server.PluginContext) error {
+	// no options are supported
+	if err := ctx.Options(&struct{}{}); err != nil {
+		return err
+	}
+	modes := server.DisabledModes(l, ctx)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.modes = modes
+	return nil
+}
+
+func (l *logger) Teardown() error {
+	l.pending.Wait()
 	return nil
 }
 
 func (l *logger) Pre(packet *server.ClientPacket) bool {
-	return server.NoopPre(packet, write)
+	return server.NoopPre(packet, l.write)
 }
 
 func (l *logger) Post(packet *server.ClientPacket) bool {
-	return server.NoopPost(packet, write)
+	return server.NoopPost(packet, l.write)
 }
 
 func (l *logger) Trace(t server.TraceType, packet *server.ClientPacket) {
-	write(server.TracingMode, t, packet)
+	l.write(server.TraceMode(t), t, packet)
+}
+
+func (l *logger) Account(packet *server.ClientPacket) bool {
+	l.write(server.AccountingMode, server.NoTrace, packet)
+	return true
 }
 
-func (l *logger) Account(packet *server.ClientPacket) {
-	write(server.AccountingMode, server.NoTrace, packet)
+func (l *logger) disabled(mode string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return server.Disabled(mode, l.modes)
 }
 
-func write(mode string, objType server.TraceType, packet *server.ClientPacket) {
+func (l *logger) write(mode string, objType server.TraceType, packet *server.ClientPacket) {
+	l.pending.Add(1)
 	go func() {
-		if server.Disabled(mode, modes) {
+		defer l.pending.Done()
+		if l.disabled(mode) {
 			return
 		}
 		dump := server.NewRequestDump(packet, mode)
 		messages := dump.DumpPacket(server.KeyValue{Key: "Info", Value: fmt.Sprintf("%d", int(objType))})
-		server.LogPluginMessages(&Plugin, messages)
+		server.LogPluginMessages(l, messages)
 	}()
 }
@@ -0,0 +1,351 @@
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/core"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+const (
+	name = "policy"
+	// function is called (by the script) for each request
+	function = "policy"
+	// replyWindow is how long reply attributes wait for the reply to the request
+	replyWindow = 30 * time.Second
+)
+
+type (
+	policy struct {
+		name    string
+		lock    *sync.RWMutex
+		opts    options
+		modes   []string
+		dict    *server.Dictionary
+		fxn     starlark.Callable
+		replies *pendingReplies
+		results *server.Counter
+	}
+
+	options struct {
+		// Script is the starlark script (relative to the lib directory) defining the policy function
+		Script string
+		// FailOpen accepts requests when the script fails
+		FailOpen bool
+	}
+
+	replyAttribute struct {
+		attr  *server.DictionaryAttribute
+		value radius.Attribute
+	}
+
+	pendingReply struct {
+		attributes []replyAttribute
+		expires    time.Time
+	}
+
+	// pendingReplies are the reply attributes (by client and request identifier) for requests being authorized
+	pendingReplies struct {
+		lock    *sync.Mutex
+		entries map[string]*pendingReply
+		swept   time.Time
+	}
+)
+
+// New creates a policy plugin instance
+func New() server.Module {
+	return newPolicy()
+}
+
+func newPolicy() *policy {
+	return &policy{name: name, lock: &sync.RWMutex{}, replies: newPendingReplies()}
+}
+
+func newPendingReplies() *pendingReplies {
+	return &pendingReplies{lock: &sync.Mutex{}, entries: make(map[string]*pendingReply)}
+}
+
+func (p *policy) Name() string {
+	return p.name
+}
+
+func (p *policy) Setup(ctx *server.PluginContext) error {
+	counter, err := ctx.Metrics().NewCounter("radiucal_policy_total", "Policy decisions by result", "result", "instance")
+	if err != nil {
+		return err
+	}
+	p.results = counter
+	p.name = ctx.InstanceName(name)
+	return p.Reload(ctx)
+}
+
+// Reload re-reads the script (keeping the loaded script when the script is invalid)
+func (p *policy) Reload(ctx *server.PluginContext) error {
+	opts := options{Script: "policy.star"}
+	if err := ctx.Options(&opts); err != nil {
+		return err
+	}
+	if !filepath.IsAbs(opts.Script) {
+		opts.Script = filepath.Join(ctx.Lib, opts.Script)
+	}
+	fxn, err := load(opts.Script)
+	if err != nil {
+		return err
+	}
+	modes := server.DisabledModes(p, ctx)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.opts = opts
+	p.modes = modes
+	p.dict = ctx.Dictionary()
+	p.fxn = fxn
+	return nil
+}
+
+// load runs a script (once) to get the policy function
+func load(script string) (starlark.Callable, error) {
+	src, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, err
+	}
+	thread := &starlark.Thread{Name: "load", Print: printer}
+	globals, err := starlark.ExecFile(thread, script, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	// frozen scripts can be called concurrently
+	globals.Freeze()
+	fxn, ok := globals[function].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s must define %s(request)", script, function)
+	}
+	return fxn, nil
+}
+
+func printer(_ *starlark.Thread, msg string) {
+	core.WriteInfo("policy", msg)
+}
+
+func (p *policy) Pre(packet *server.ClientPacket) bool {
+	p.lock.RLock()
+	opts := p.opts
+	fxn := p.fxn
+	dict := p.dict
+	disabled := server.Disabled(server.PreAuthMode, p.modes)
+	p.lock.RUnlock()
+	if disabled || packet.Packet == nil || fxn == nil {
+		return true
+	}
+	accept, reply, err := evaluate(fxn, dict, packet, time.Now())
+	if err != nil {
+		core.WriteWarn(fmt.Sprintf("policy failed: %s (%v)", p.Name(), err))
+		p.results.Inc("error", p.Name())
+		return opts.FailOpen
+	}
+	if !accept {
+		p.results.Inc("reject", p.Name())
+		kv := server.KeyValueStore{}
+		kv.DropEmpty = true
+		kv.Add("Result", "REJECT")
+		kv.Add("User-Name", rfc2865.UserName_GetString(packet.Packet))
+		kv.Add("Calling-Station-Id", rfc2865.CallingStationID_GetString(packet.Packet))
+		kv.Add("Id", strconv.Itoa(int(packet.Packet.Identifier)))
+		server.LogPluginMessages(p, kv.Strings())
+		return false
+	}
+	p.results.Inc("accept", p.Name())
+	if len(reply) > 0 && packet.ClientAddr != nil {
+		p.replies.put(replyKey(packet), reply, time.Now())
+	}
+	return true
+}
+
+// Post adds the reply attributes (of the accepted request) to the reply
+func (p *policy) Post(packet *server.ClientPacket) bool {
+	p.lock.RLock()
+	disabled := server.Disabled(server.PostAuthMode, p.modes)
+	p.lock.RUnlock()
+	if disabled || packet.Packet == nil || packet.ClientAddr == nil {
+		return true
+	}
+	reply := p.replies.take(replyKey(packet), time.Now())
+	if len(reply) == 0 || packet.Packet.Code != radius.CodeAccessAccept {
+		return true
+	}
+	for _, r := range reply {
+		if err := r.attr.Add(packet.Packet, r.value); err != nil {
+			core.WriteWarn(fmt.Sprintf("unable to add reply attribute: %s (%v)", r.attr.Name, err))
+			continue
+		}
+		packet.Modified = true
+	}
+	return true
+}
+
+func replyKey(packet *server.ClientPacket) string {
+	return fmt.Sprintf("%s/%d", packet.ClientAddr.String(), packet.Packet.Identifier)
+}
+
+// newRequest is the request given to the policy function
+func newRequest(dict *server.Dictionary, packet *server.ClientPacket, now time.Time) *starlarkstruct.Struct {
+	values := dict.Values(packet.Packet)
+	attributes := starlark.NewDict(len(values))
+	var names []string
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		var list []starlark.Value
+		for _, v := range values[k] {
+			list = append(list, starlark.String(v))
+		}
+		attributes.SetKey(starlark.String(k), starlark.NewList(list))
+	}
+	attributes.Freeze()
+	client, ip := "", ""
+	if packet.ClientAddr != nil {
+		client = packet.ClientAddr.String()
+		ip = packet.ClientAddr.IP.String()
+	}
+	value := starlark.NewBuiltin("value", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+			return nil, err
+		}
+		if v := values[name]; len(v) > 0 {
+			return starlark.String(v[0]), nil
+		}
+		return starlark.None, nil
+	})
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"code":       starlark.String(packet.Packet.Code.String()),
+		"identifier": starlark.MakeInt(int(packet.Packet.Identifier)),
+		"client":     starlark.String(client),
+		"client_ip":  starlark.String(ip),
+		"attributes": attributes,
+		"value":      value,
+		"time": starlarkstruct.FromStringDict(starlark.String("time"), starlark.StringDict{
+			"unix":    starlark.MakeInt64(now.Unix()),
+			"year":    starlark.MakeInt(now.Year()),
+			"month":   starlark.MakeInt(int(now.Month())),
+			"day":     starlark.MakeInt(now.Day()),
+			"weekday": starlark.MakeInt(int(now.Weekday())),
+			"hour":    starlark.MakeInt(now.Hour()),
+			"minute":  starlark.MakeInt(now.Minute()),
+		}),
+	})
+}
+
+// evaluate calls the policy function for a request, the function returns if the request is accepted, optionally with
+// reply attributes (as a tuple of the decision and a dictionary of attribute names to values)
+func evaluate(fxn starlark.Callable, dict *server.Dictionary, packet *server.ClientPacket, now time.Time) (bool, []replyAttribute, error) {
+	thread := &starlark.Thread{Name: function, Print: printer}
+	result, err := starlark.Call(thread, fxn, starlark.Tuple{newRequest(dict, packet, now)}, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	var reply starlark.Value
+	if t, ok := result.(starlark.Tuple); ok {
+		if len(t) != 2 {
+			return false, nil, fmt.Errorf("%s must return a decision and reply attributes", function)
+		}
+		result = t[0]
+		reply = t[1]
+	}
+	accept, ok := result.(starlark.Bool)
+	if !ok {
+		return false, nil, fmt.Errorf("%s must return a bool decision, not %s", function, result.Type())
+	}
+	if !accept || reply == nil || reply == starlark.None {
+		return bool(accept), nil, nil
+	}
+	attributes, err := replyAttributes(dict, reply)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, attributes, nil
+}
+
+// replyAttributes encodes the reply attributes (a dictionary of names to a value or a list of values)
+func replyAttributes(dict *server.Dictionary, reply starlark.Value) ([]replyAttribute, error) {
+	d, ok := reply.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("reply attributes must be a dict, not %s", reply.Type())
+	}
+	var results []replyAttribute
+	for _, item := range d.Items() {
+		attrName, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("reply attribute names must be strings")
+		}
+		attr := dict.Attribute(attrName)
+		if attr == nil {
+			return nil, fmt.Errorf("unknown attribute: %s", attrName)
+		}
+		if attr.Encrypted() {
+			return nil, fmt.Errorf("encrypted attributes can not be replied: %s", attrName)
+		}
+		values := []starlark.Value{item[1]}
+		if list, ok := item[1].(*starlark.List); ok {
+			values = nil
+			for i := 0; i < list.Len(); i++ {
+				values = append(values, list.Index(i))
+			}
+		}
+		for _, v := range values {
+			text, ok := starlark.AsString(v)
+			if !ok {
+				i, isInt := v.(starlark.Int)
+				if !isInt {
+					return nil, fmt.Errorf("invalid value for %s: %s", attrName, v.String())
+				}
+				text = i.String()
+			}
+			value, err := attr.Encode(text)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, replyAttribute{attr: attr, value: value})
+		}
+	}
+	return results, nil
+}
+
+func (r *pendingReplies) put(key string, attributes []replyAttribute, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now.Sub(r.swept) >= time.Second {
+		for k, e := range r.entries {
+			if !now.Before(e.expires) {
+				delete(r.entries, k)
+			}
+		}
+		r.swept = now
+	}
+	r.entries[key] = &pendingReply{attributes: attributes, expires: now.Add(replyWindow)}
+}
+
+func (r *pendingReplies) take(key string, now time.Time) []replyAttribute {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(r.entries, key)
+	if !now.Before(e.expires) {
+		return nil
+	}
+	return e.attributes
+}
@@ -0,0 +1,164 @@
+package policy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+const (
+	testScript = `
+printers = ["printer"]
+
+def policy(request):
+    user = request.value("User-Name")
+    if user in printers:
+        return request.value("NAS-Identifier") == "switch-3"
+    if user == "guest":
+        if request.time.weekday in [0, 6] or request.time.hour < 8 or request.time.hour >= 17:
+            return (True, {"Reply-Message": "guest", "Session-Timeout": 3600})
+        return False
+    if user == "error":
+        fail("policy error")
+    if user == "invalid":
+        return "yes"
+    if user == "badreply":
+        return (True, {"Not-An-Attribute": "value"})
+    return request.client_ip == "127.0.0.1" and len(request.attributes["User-Name"]) == 1
+`
+)
+
+func newTestPlugin(t *testing.T, script string, opts map[string]interface{}) (*policy, string, error) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal("unable to create dir", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "policy.star"), []byte(script), 0644); err != nil {
+		t.Fatal("unable to write script", err)
+	}
+	p := newPolicy()
+	err = p.Setup(server.NewPluginContext(&server.Configuration{Dir: dir}).ForPlugin(server.PluginConfig{Name: "policy", Options: opts}))
+	return p, dir, err
+}
+
+func newPacket(user, nas string) *server.ClientPacket {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1234")
+	p := server.NewClientPacket(nil, addr)
+	p.Packet = radius.New(radius.CodeAccessRequest, []byte("secret"))
+	p.Packet.Identifier = 10
+	rfc2865.UserName_AddString(p.Packet, user)
+	if len(nas) > 0 {
+		rfc2865.NASIdentifier_AddString(p.Packet, nas)
+	}
+	return p
+}
+
+func TestPolicy(t *testing.T) {
+	p, dir, err := newTestPlugin(t, testScript, nil)
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	if p.Name() != "policy" {
+		t.Error("invalid name")
+	}
+	if !p.Pre(newPacket("user", "")) || !p.Pre(newPacket("printer", "switch-3")) {
+		t.Error("should accept")
+	}
+	if p.Pre(newPacket("printer", "switch-1")) {
+		t.Error("printers only from switch-3")
+	}
+	for _, user := range []string{"error", "invalid", "badreply"} {
+		if p.Pre(newPacket(user, "")) {
+			t.Error("should fail closed", user)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "policy.star"), []byte("def policy(request):\n    return False\n"), 0644)
+	ctx := server.NewPluginContext(&server.Configuration{Dir: dir}).ForPlugin(server.PluginConfig{Name: "policy", Options: map[string]interface{}{"failopen": true}})
+	if err := p.Reload(ctx); err != nil {
+		t.Fatal("should reload", err)
+	}
+	if p.Pre(newPacket("user", "")) {
+		t.Error("reloaded script rejects")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "policy.star"), []byte("def policy(request):\n    fail()\n"), 0644)
+	p.Reload(ctx)
+	if !p.Pre(newPacket("user", "")) {
+		t.Error("should fail open")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "policy.star"), []byte("def other(request):\n    return True\n"), 0644)
+	if err := p.Reload(ctx); err == nil {
+		t.Error("policy function is required")
+	}
+	if !p.Pre(newPacket("user", "")) {
+		t.Error("invalid script should not be loaded")
+	}
+}
+
+func TestPolicyReply(t *testing.T) {
+	p, dir, err := newTestPlugin(t, testScript, nil)
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	weekday := time.Date(2020, time.March, 4, 12, 0, 0, 0, time.Local)
+	evening := time.Date(2020, time.March, 4, 20, 0, 0, 0, time.Local)
+	request := newPacket("guest", "")
+	if accept, _, err := evaluate(p.fxn, p.dict, request, weekday); err != nil || accept {
+		t.Error("guests not allowed in business hours", err)
+	}
+	accept, reply, err := evaluate(p.fxn, p.dict, request, evening)
+	if err != nil || !accept || len(reply) != 2 {
+		t.Fatal("guests allowed outside business hours", err)
+	}
+	p.replies.put(replyKey(request), reply, time.Now())
+	response := server.NewClientPacket(nil, request.ClientAddr)
+	response.Packet = radius.New(radius.CodeAccessAccept, []byte("secret"))
+	response.Packet.Identifier = request.Packet.Identifier
+	if !p.Post(response) || !response.Modified {
+		t.Fatal("reply should be modified")
+	}
+	if rfc2865.ReplyMessage_GetString(response.Packet) != "guest" || rfc2865.SessionTimeout_Get(response.Packet) != 3600 {
+		t.Error("invalid reply attributes")
+	}
+	response = server.NewClientPacket(nil, request.ClientAddr)
+	response.Packet = radius.New(radius.CodeAccessAccept, []byte("secret"))
+	response.Packet.Identifier = request.Packet.Identifier
+	if !p.Post(response) || response.Modified {
+		t.Error("reply attributes are only added once")
+	}
+	p.replies.put(replyKey(request), reply, time.Now())
+	response.Packet.Code = radius.CodeAccessReject
+	if !p.Post(response) || response.Modified {
+		t.Error("rejects should not be modified")
+	}
+	p.replies.put(replyKey(request), reply, time.Now().Add(-replyWindow))
+	response.Packet.Code = radius.CodeAccessAccept
+	if !p.Post(response) || response.Modified {
+		t.Error("reply attributes should expire")
+	}
+}
+
+func TestPolicyOptions(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		opts   map[string]interface{}
+	}{
+		{script: "def policy(request)"},
+		{script: testScript, opts: map[string]interface{}{"script": "missing.star"}},
+		{script: testScript, opts: map[string]interface{}{"unknown": true}},
+	} {
+		_, dir, err := newTestPlugin(t, c.script, c.opts)
+		os.RemoveAll(dir)
+		if err == nil {
+			t.Error("should fail", c.script, c.opts)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package rewrite
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"layeh.com/radius"
+	"layeh.com/radius/dictionary"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+const (
+	macAction    = "mac"
+	lowerAction  = "lower"
+	upperAction  = "upper"
+	stripAction  = "strip"
+	addAction    = "add"
+	setAction    = "set"
+	removeAction = "remove"
+)
+
+const (
+	name = "rewrite"
+)
+
+type (
+	rewriter struct {
+		name  string
+		lock  *sync.RWMutex
+		rules []*rule
+		modes []string
+	}
+
+	options struct {
+		// Rules replace the (top-level) rewrite rules
+		Rules []server.RewriteRule
+	}
+
+	rule struct {
+		name   string
+		kind   radius.Type
+		action string
+		param  string
+		value  radius.Attribute
+	}
+)
+
+// New creates a rewrite plugin instance
+func New() server.Module {
+	return newRewriter()
+}
+
+func newRewriter() *rewriter {
+	return &rewriter{name: name, lock: &sync.RWMutex{}}
+}
+
+func (r *rewriter) Name() string {
+	return r.name
+}
+
+func (r *rewriter) Setup(ctx *server.PluginContext) error {
+	r.name = ctx.InstanceName(name)
+	return r.Reload(ctx)
+}
+
+func (r *rewriter) Reload(ctx *server.PluginContext) error {
+	opts := &options{}
+	if err := ctx.Options(opts); err != nil {
+		return err
+	}
+	configured := opts.Rules
+	if len(configured) == 0 {
+		configured = ctx.Rewrites()
+	}
+	parsed, err := parseRules(ctx.Dictionary(), configured)
+	if err != nil {
+		return err
+	}
+	modes := server.DisabledModes(r, ctx)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rules = parsed
+	r.modes = modes
+	return nil
+}
+
+func (r *rewriter) Pre(packet *server.ClientPacket) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if packet.Packet == nil || server.Disabled(server.PreAuthMode, r.modes) {
+		return true
+	}
+	for _, rule := range r.rules {
+		if rule.apply(packet.Packet) {
+			packet.Modified = true
+		}
+	}
+	return true
+}
+
+func parseRules(dict *server.Dictionary, configured []server.RewriteRule) ([]*rule, error) {
+	var parsed []*rule
+	for idx, c := range configured {
+		r, err := parseRule(dict, c)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %v", idx, err)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+func parseRule(dict *server.Dictionary, c server.RewriteRule) (*rule, error) {
+	attr := dict.Attribute(c.Attribute)
+	if attr == nil {
+		return nil, fmt.Errorf("unknown attribute: %s", c.Attribute)
+	}
+	if attr.Vendor != 0 {
+		return nil, fmt.Errorf("vendor attributes can not be rewritten: %s", c.Attribute)
+	}
+	if attr.Encrypted() {
+		return nil, fmt.Errorf("encrypted attributes can not be rewritten: %s", c.Attribute)
+	}
+	r := &rule{name: attr.Name, kind: radius.Type(attr.Type), action: c.Action, param: c.Value}
+	switch c.Action {
+	case macAction:
+		if len(r.param) == 0 {
+			r.param = "ieee"
+		}
+		if _, ok := formatMAC("aabbccddeeff", r.param); !ok {
+			return nil, fmt.Errorf("unknown mac format: %s", r.param)
+		}
+	case stripAction:
+		if len(r.param) == 0 {
+			r.param = "@"
+		}
+	case lowerAction, upperAction, removeAction:
+	case addAction, setAction:
+		value, err := attr.Encode(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		r.value = value
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unknown action: %s", c.Action)
+	}
+	if c.Action != removeAction && attr.Kind != dictionary.AttributeString {
+		return nil, fmt.Errorf("%s requires a string attribute: %s", c.Action, c.Attribute)
+	}
+	return r, nil
+}
+
+// formatMAC writes a (normalized) MAC as ieee (AA-BB-CC-DD-EE-FF), colon (aa:bb:cc:dd:ee:ff), dot (aabb.ccdd.eeff),
+// or bare (aabbccddeeff)
+func formatMAC(mac, format string) (string, bool) {
+	var parts []string
+	switch format {
+	case "ieee", "colon":
+		for i := 0; i < len(mac); i += 2 {
+			parts = append(parts, mac[i:i+2])
+		}
+		if format == "ieee" {
+			return strings.ToUpper(strings.Join(parts, "-")), true
+		}
+		return strings.Join(parts, ":"), true
+	case "dot":
+		for i := 0; i < len(mac); i += 4 {
+			parts = append(parts, mac[i:i+4])
+		}
+		return strings.Join(parts, "."), true
+	case "bare":
+		return mac, true
+	}
+	return "", false
+}
+
+func (r *rule) rewrite(value string) string {
+	switch r.action {
+	case macAction:
+		if mac := server.NormalizeMAC(value); len(mac) > 0 {
+			formatted, _ := formatMAC(mac, r.param)
+			return formatted
+		}
+	case lowerAction:
+		return strings.ToLower(value)
+	case upperAction:
+		return strings.ToUpper(value)
+	case stripAction:
+		// realm/user (and DOMAIN\user) are prefixed, user@realm is suffixed
+		if r.param == "/" || r.param == "\\" {
+			if idx := strings.Index(value, r.param); idx >= 0 {
+				return value[idx+len(r.param):]
+			}
+		} else if idx := strings.LastIndex(value, r.param); idx >= 0 {
+			return value[0:idx]
+		}
+	}
+	return value
+}
+
+// apply rewrites the packet, indicating if the packet was changed
+func (r *rule) apply(p *radius.Packet) bool {
+	switch r.action {
+	case addAction:
+		p.Add(r.kind, r.value)
+		return true
+	case setAction:
+		p.Set(r.kind, r.value)
+		return true
+	case removeAction:
+		if _, ok := p.Lookup(r.kind); !ok {
+			return false
+		}
+		p.Del(r.kind)
+		return true
+	}
+	changed := false
+	for _, avp := range p.Attributes {
+		if avp.Type != r.kind {
+			continue
+		}
+		value := r.rewrite(radius.String(avp.Attribute))
+		if value == radius.String(avp.Attribute) {
+			continue
+		}
+		attr, err := radius.NewString(value)
+		if err != nil {
+			continue
+		}
+		avp.Attribute = attr
+		changed = true
+	}
+	return changed
+}
@@ -0,0 +1,141 @@
+package rewrite
+
+import (
+	"net"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+func setupRules(t *testing.T, rules ...server.RewriteRule) *rewriter {
+	r := newRewriter()
+	ctx := server.NewPluginContext(&server.Configuration{Rewrite: rules})
+	if err := r.Setup(ctx); err != nil {
+		t.Fatal("unable to setup", err)
+	}
+	return r
+}
+
+func newPacket(t *testing.T) *server.ClientPacket {
+	p := server.NewClientPacket(nil, nil)
+	p.Packet = radius.New(radius.CodeAccessRequest, []byte("secret"))
+	rfc2865.UserName_AddString(p.Packet, "User@REALM")
+	rfc2865.CallingStationID_AddString(p.Packet, "aa:bb:cc:dd:ee:ff")
+	rfc2865.NASIdentifier_AddString(p.Packet, "nas")
+	return p
+}
+
+func TestParseRules(t *testing.T) {
+	for _, r := range []server.RewriteRule{
+		{Attribute: "Not-An-Attribute", Action: lowerAction},
+		{Attribute: "User-Password", Action: lowerAction},
+		{Attribute: "User-Name", Action: "unknown"},
+		{Attribute: "User-Name", Action: macAction, Value: "unknown"},
+		{Attribute: "NAS-Port", Action: lowerAction},
+		{Attribute: "NAS-Port", Action: setAction, Value: "abc"},
+		{Attribute: "NAS-IP-Address", Action: setAction, Value: "abc"},
+	} {
+		if _, err := parseRules(server.NewPluginContext(&server.Configuration{}).Dictionary(), []server.RewriteRule{r}); err == nil {
+			t.Error("rule should be invalid", r)
+		}
+	}
+	parsed, err := parseRules(server.NewPluginContext(&server.Configuration{}).Dictionary(), []server.RewriteRule{
+		{Attribute: "User-Name", Action: macAction},
+		{Attribute: "Service-Type", Action: setAction, Value: "Framed-User"},
+		{Attribute: "NAS-Port", Action: addAction, Value: "10"},
+		{Attribute: "NAS-IP-Address", Action: setAction, Value: "10.0.0.1"},
+		{Attribute: "NAS-Port", Action: removeAction},
+	})
+	if err != nil || len(parsed) != 5 {
+		t.Fatal("rules should be valid", err)
+	}
+	if parsed[0].param != "ieee" {
+		t.Error("mac should default to ieee")
+	}
+}
+
+func TestFormatMAC(t *testing.T) {
+	for format, out := range map[string]string{
+		"ieee":  "AA-BB-CC-DD-EE-FF",
+		"colon": "aa:bb:cc:dd:ee:ff",
+		"dot":   "aabb.ccdd.eeff",
+		"bare":  "aabbccddeeff",
+	} {
+		if formatted, ok := formatMAC("aabbccddeeff", format); !ok || formatted != out {
+			t.Error("invalid format", format, formatted)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	for _, c := range []struct {
+		action string
+		param  string
+		in     string
+		out    string
+	}{
+		{macAction, "ieee", "aa:bb:cc:dd:ee:ff", "AA-BB-CC-DD-EE-FF"},
+		{macAction, "bare", "user", "user"},
+		{lowerAction, "", "User", "user"},
+		{upperAction, "", "User", "USER"},
+		{stripAction, "@", "user@realm", "user"},
+		{stripAction, "@", "user", "user"},
+		{stripAction, "/", "realm/user", "user"},
+		{stripAction, "\\", "DOMAIN\\user", "user"},
+	} {
+		r := &rule{action: c.action, param: c.param}
+		if r.rewrite(c.in) != c.out {
+			t.Error("invalid rewrite", c)
+		}
+	}
+}
+
+func TestPre(t *testing.T) {
+	r := setupRules(t,
+		server.RewriteRule{Attribute: "User-Name", Action: stripAction},
+		server.RewriteRule{Attribute: "User-Name", Action: lowerAction},
+		server.RewriteRule{Attribute: "Calling-Station-Id", Action: macAction},
+		server.RewriteRule{Attribute: "NAS-Identifier", Action: removeAction},
+		server.RewriteRule{Attribute: "NAS-IP-Address", Action: setAction, Value: "10.0.0.1"},
+		server.RewriteRule{Attribute: "Service-Type", Action: addAction, Value: "Framed-User"},
+	)
+	p := newPacket(t)
+	if !r.Pre(p) || !p.Modified {
+		t.Fatal("packet should be modified")
+	}
+	if rfc2865.UserName_GetString(p.Packet) != "user" {
+		t.Error("invalid user")
+	}
+	if rfc2865.CallingStationID_GetString(p.Packet) != "AA-BB-CC-DD-EE-FF" {
+		t.Error("invalid mac")
+	}
+	if _, ok := p.Packet.Lookup(rfc2865.NASIdentifier_Type); ok {
+		t.Error("nas identifier should be removed")
+	}
+	if !rfc2865.NASIPAddress_Get(p.Packet).Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("invalid nas address")
+	}
+	if rfc2865.ServiceType_Get(p.Packet) != rfc2865.ServiceType_Value_FramedUser {
+		t.Error("invalid service type")
+	}
+	r = setupRules(t, server.RewriteRule{Attribute: "User-Name", Action: lowerAction})
+	p = newPacket(t)
+	rfc2865.UserName_SetString(p.Packet, "user")
+	if !r.Pre(p) || p.Modified {
+		t.Error("unchanged packet should not be modified")
+	}
+	config := &server.Configuration{Rewrite: []server.RewriteRule{{Attribute: "User-Name", Action: upperAction}}}
+	config.Disable.Preauth = []string{"rewrite"}
+	if err := r.Reload(server.NewPluginContext(config)); err != nil {
+		t.Fatal("unable to reload", err)
+	}
+	p = newPacket(t)
+	if !r.Pre(p) || p.Modified {
+		t.Error("preauth is disabled")
+	}
+	if err := newRewriter().Setup(server.NewPluginContext(&server.Configuration{Rewrite: []server.RewriteRule{{Attribute: "User-Name"}}})); err == nil {
+		t.Error("invalid rules should not load")
+	}
+}
@@ -14,34 +14,51 @@ import (
 	"voidedtech.com/radiucal/internal/server"
 )
 
+const (
+	name = "usermac"
+)
+
 type (
 	umac struct {
+		name     string
+		lock     *sync.Mutex
+		file     string
+		manifest map[string]bool
+		results  *server.Counter
+		pending  *sync.WaitGroup
+	}
+
+	options struct {
+		// Manifest is the manifest file (relative to the lib directory)
+		Manifest string
 	}
 )
 
-func (l *umac) Name() string {
-	return "usermac"
+// New creates a usermac plugin instance
+func New() server.Module {
+	return newUserMac()
 }
 
-var (
-	lock     = &sync.Mutex{}
-	file     string
-	manifest = make(map[string]bool)
-	// Plugin represents the instance for the system
-	Plugin umac
-)
+func newUserMac() *umac {
+	return &umac{name: name, lock: &sync.Mutex{}, manifest: make(map[string]bool), pending: &sync.WaitGroup{}}
+}
+
+func (l *umac) Name() string {
+	return l.name
+}
 
-func (l *umac) load() error {
+func (l *umac) load(file string) error {
 	if !core.PathExists(file) {
 		return fmt.Errorf("%s is missing", file)
 	}
-	lock.Lock()
-	defer lock.Unlock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	b, err := ioutil.ReadFile(file)
 	if err != nil {
 		return err
 	}
-	manifest = make(map[string]bool)
+	l.file = file
+	l.manifest = make(map[string]bool)
 	data := strings.Split(string(b), "\n")
 	kv := server.KeyValueStore{}
 	kv.Add("Manfiest", "load")
@@ -51,23 +68,42 @@ func (l *umac) load() error {
 			continue
 		}
 		kv.Add(fmt.Sprintf("Manifest-%d", idx), d)
-		manifest[d] = true
+		l.manifest[d] = true
 		idx++
 	}
-	server.LogPluginMessages(&Plugin, kv.Strings())
+	server.LogPluginMessages(l, kv.Strings())
 	return nil
 }
 
 func (l *umac) Setup(ctx *server.PluginContext) error {
-	file = filepath.Join(ctx.Lib, "manifest")
-	if err := l.load(); err != nil {
+	counter, err := ctx.Metrics().NewCounter("radiucal_usermac_total", "User+MAC checks by result", "result", "instance")
+	if err != nil {
+		return err
+	}
+	l.results = counter
+	l.name = ctx.InstanceName(name)
+	return l.Reload(ctx)
+}
+
+func (l *umac) Reload(ctx *server.PluginContext) error {
+	opts := &options{Manifest: "manifest"}
+	if err := ctx.Options(opts); err != nil {
 		return err
 	}
+	file := opts.Manifest
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(ctx.Lib, file)
+	}
+	return l.load(file)
+}
+
+func (l *umac) Teardown() error {
+	l.pending.Wait()
 	return nil
 }
 
 func (l *umac) Pre(packet *server.ClientPacket) bool {
-	return checkUserMac(packet) == nil
+	return l.check(packet) == nil
 }
 
 func clean(in string) string {
@@ -80,7 +116,7 @@ func clean(in string) string {
 	return result
 }
 
-func checkUserMac(p *server.ClientPacket) error {
+func (l *umac) check(p *server.ClientPacket) error {
 	username, err := rfc2865.UserName_LookupString(p.Packet)
 	if err != nil {
 		return err
@@ -94,18 +130,22 @@ func checkUserMac(p *server.ClientPacket) error {
 	fqdn := core.NewManifestEntry(username, calling)
 	success := true
 	var failure error
-	lock.Lock()
-	_, ok := manifest[fqdn]
-	lock.Unlock()
+	l.lock.Lock()
+	_, ok := l.manifest[fqdn]
+	l.lock.Unlock()
 	if !ok {
 		failure = fmt.Errorf("failed preauth: %s %s", username, calling)
 		success = false
 	}
-	go mark(success, username, calling, p, false)
+	l.pending.Add(1)
+	go func() {
+		defer l.pending.Done()
+		l.mark(success, username, calling, p, false)
+	}()
 	return failure
 }
 
-func mark(success bool, user, calling string, p *server.ClientPacket, cached bool) {
+func (l *umac) mark(success bool, user, calling string, p *server.ClientPacket, cached bool) {
 	nas := clean(rfc2865.NASIdentifier_GetString(p.Packet))
 	if len(nas) == 0 {
 		nas = "unknown"
@@ -127,6 +167,9 @@ func mark(success bool, user, calling string, p *server.ClientPacket, cached boo
 	if !success {
 		result = "FAILED"
 	}
+	if l.results != nil {
+		l.results.Inc(strings.ToLower(result), l.Name())
+	}
 	kv := server.KeyValueStore{}
 	kv.Add("Result", result)
 	kv.Add("User-Name", user)
@@ -135,5 +178,5 @@ func mark(success bool, user, calling string, p *server.ClientPacket, cached boo
 	kv.Add("NAS-IPAddress", nasip)
 	kv.Add("NAS-Port", fmt.Sprintf("%d", nasport))
 	kv.Add("Id", strconv.Itoa(int(p.Packet.Identifier)))
-	server.LogPluginMessages(&Plugin, kv.Strings())
+	server.LogPluginMessages(l, kv.Strings())
 }
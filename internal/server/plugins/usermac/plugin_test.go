@@ -1,6 +1,11 @@
 package usermac
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"layeh.com/radius"
@@ -14,7 +19,7 @@ func TestUserMacBasics(t *testing.T) {
 }
 
 func ErrorIfNotPre(t *testing.T, m *umac, p *server.ClientPacket, message string) {
-	err := checkUserMac(p)
+	err := m.check(p)
 	if err == nil {
 		if message != "" {
 			t.Errorf("expected to fail with: %s", message)
@@ -31,6 +36,10 @@ func newTestSet(t *testing.T, user, mac string, valid bool) (*server.ClientPacke
 	if m.Name() != "usermac" {
 		t.Error("invalid/wrong name")
 	}
+	return newInstanceTestSet(t, m, user, mac, valid)
+}
+
+func newInstanceTestSet(t *testing.T, m *umac, user, mac string, valid bool) (*server.ClientPacket, *umac) {
 	var secret = []byte("secret")
 	p := server.NewClientPacket(nil, nil)
 	p.Packet = radius.New(radius.CodeAccessRequest, secret)
@@ -46,15 +55,14 @@ func newTestSet(t *testing.T, user, mac string, valid bool) (*server.ClientPacke
 		ErrorIfNotPre(t, m, p, "")
 	}
 	if !valid {
-		ErrorIfNotPre(t, m, p, "failed preauth: test "+clean(mac))
+		ErrorIfNotPre(t, m, p, "failed preauth: "+user+" "+clean(mac))
 	}
 	return p, m
 }
 
 func setupUserMac() *umac {
-	file = "./tests/manifest"
-	m := &umac{}
-	m.load()
+	m := newUserMac()
+	m.load("./tests/manifest")
 	return m
 }
 
@@ -65,3 +73,86 @@ func TestUserMacCache(t *testing.T) {
 	ErrorIfNotPre(t, m, pg, "")
 	ErrorIfNotPre(t, m, pb, first)
 }
+
+func TestUserMacTeardown(t *testing.T) {
+	registry := server.NewMetricRegistry()
+	counter, err := registry.NewCounter("usermac_test_total", "test", "result", "instance")
+	if err != nil {
+		t.Fatal("unable to create counter", err)
+	}
+	m := setupUserMac()
+	m.results = counter
+	pg, _ := newInstanceTestSet(t, m, "test", "11-22-33-44-55-66", true)
+	if !m.Pre(pg) {
+		t.Error("should pass")
+	}
+	if err := m.Teardown(); err != nil {
+		t.Error("teardown failed", err)
+	}
+	var b bytes.Buffer
+	registry.Write(&b)
+	if !strings.Contains(b.String(), `usermac_test_total{result="passed",instance="usermac"} 2`) {
+		t.Error("marks should be written before teardown completes", b.String())
+	}
+}
+
+func TestUserMacOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usermac")
+	if err != nil {
+		t.Fatal("unable to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest"), []byte("test.112233445566\n"), 0644); err != nil {
+		t.Fatal("unable to write manifest", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "guests"), []byte("guest.112233445577\n"), 0644); err != nil {
+		t.Fatal("unable to write manifest", err)
+	}
+	conf := &server.Configuration{Dir: dir}
+	ctx := server.NewPluginContext(conf)
+	m := newUserMac()
+	if err := m.Setup(ctx.ForPlugin(server.PluginConfig{Name: "usermac"})); err != nil {
+		t.Error("should setup", err)
+	}
+	guests := newUserMac()
+	if err := guests.Setup(ctx.ForPlugin(server.PluginConfig{Name: "usermac", Alias: "guests", Options: map[string]interface{}{"manifest": "guests"}})); err != nil {
+		t.Error("should setup", err)
+	}
+	if m.Name() != "usermac" || guests.Name() != "guests" {
+		t.Error("invalid instance names", m.Name(), guests.Name())
+	}
+	newInstanceTestSet(t, m, "test", "11-22-33-44-55-66", true)
+	newInstanceTestSet(t, m, "guest", "11-22-33-44-55-77", false)
+	newInstanceTestSet(t, guests, "guest", "11-22-33-44-55-77", true)
+	newInstanceTestSet(t, guests, "test", "11-22-33-44-55-66", false)
+	m.Teardown()
+	guests.Teardown()
+	if err := newUserMac().Setup(ctx.ForPlugin(server.PluginConfig{Name: "usermac", Options: map[string]interface{}{"manifest": "missing"}})); err == nil {
+		t.Error("manifest should be missing")
+	}
+	if err := newUserMac().Setup(ctx.ForPlugin(server.PluginConfig{Name: "usermac", Options: map[string]interface{}{"file": "guests"}})); err == nil {
+		t.Error("unknown option should fail")
+	}
+}
+
+func TestUserMacReload(t *testing.T) {
+	ctx := server.NewPluginContext(&server.Configuration{Dir: "./tests"}).ForPlugin(server.PluginConfig{Name: "usermac"})
+	m := newUserMac()
+	if err := m.Setup(ctx); err != nil {
+		t.Fatal("should setup", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if err := m.Reload(ctx); err != nil {
+				t.Error("should reload", err)
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		newInstanceTestSet(t, m, "test", "11-22-33-44-55-66", true)
+	}
+	<-done
+	m.Teardown()
+}
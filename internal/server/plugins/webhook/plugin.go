@@ -0,0 +1,277 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/core"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+const (
+	name = "webhook"
+	// maximum size of a response body
+	maxBody = 64 * 1024
+)
+
+type (
+	webhook struct {
+		name    string
+		lock    *sync.RWMutex
+		opts    options
+		modes   []string
+		client  *http.Client
+		cache   *resultCache
+		results *server.Counter
+	}
+
+	options struct {
+		// URL is the endpoint requests are posted to
+		URL string
+		// Timeout is how long (seconds) to wait for a decision
+		Timeout int
+		// FailOpen accepts packets when the endpoint does not decide (timeout, error)
+		FailOpen bool
+		// Cache is how long (seconds, negative to not cache) decisions are remembered for up to Entries requests
+		Cache   int
+		Entries int
+	}
+
+	// request is posted (as JSON) for each packet
+	request struct {
+		Mode           string `json:"mode"`
+		Client         string `json:"client,omitempty"`
+		Code           string `json:"code"`
+		UserName       string `json:"user"`
+		CallingStation string `json:"calling"`
+		NASIdentifier  string `json:"nas_identifier,omitempty"`
+		NASAddress     string `json:"nas_ip,omitempty"`
+		NASPort        uint32 `json:"nas_port"`
+	}
+
+	// response is the (JSON) decision of the endpoint
+	response struct {
+		Accept  bool   `json:"accept"`
+		Message string `json:"message,omitempty"`
+	}
+
+	cacheEntry struct {
+		accept  bool
+		expires time.Time
+	}
+
+	resultCache struct {
+		lock    *sync.Mutex
+		window  time.Duration
+		size    int
+		entries map[string]*cacheEntry
+	}
+)
+
+// New creates a webhook plugin instance
+func New() server.Module {
+	return newWebhook()
+}
+
+func newWebhook() *webhook {
+	return &webhook{name: name, lock: &sync.RWMutex{}}
+}
+
+func newResultCache(window time.Duration, size int) *resultCache {
+	return &resultCache{lock: &sync.Mutex{}, window: window, size: size, entries: make(map[string]*cacheEntry)}
+}
+
+func (w *webhook) Name() string {
+	return w.name
+}
+
+func (w *webhook) Setup(ctx *server.PluginContext) error {
+	counter, err := ctx.Metrics().NewCounter("radiucal_webhook_total", "Webhook decisions by result", "result", "instance")
+	if err != nil {
+		return err
+	}
+	w.results = counter
+	w.name = ctx.InstanceName(name)
+	return w.Reload(ctx)
+}
+
+// Reload reads the options (forgetting cached decisions)
+func (w *webhook) Reload(ctx *server.PluginContext) error {
+	opts := options{}
+	if err := ctx.Options(&opts); err != nil {
+		return err
+	}
+	u, err := url.Parse(opts.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("webhook requires an http(s) url: %s", opts.URL)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2
+	}
+	if opts.Cache == 0 {
+		opts.Cache = 30
+	}
+	if opts.Cache < 0 {
+		opts.Cache = 0
+	}
+	if opts.Entries <= 0 {
+		opts.Entries = 1024
+	}
+	modes := server.DisabledModes(w, ctx)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.opts = opts
+	w.modes = modes
+	w.client = &http.Client{Timeout: time.Duration(opts.Timeout) * time.Second}
+	w.cache = newResultCache(time.Duration(opts.Cache)*time.Second, opts.Entries)
+	return nil
+}
+
+func (w *webhook) Pre(packet *server.ClientPacket) bool {
+	return w.decide(server.PreAuthMode, packet)
+}
+
+func (w *webhook) Post(packet *server.ClientPacket) bool {
+	return w.decide(server.PostAuthMode, packet)
+}
+
+func newRequest(mode string, packet *server.ClientPacket) *request {
+	req := &request{
+		Mode:           mode,
+		Code:           packet.Packet.Code.String(),
+		UserName:       rfc2865.UserName_GetString(packet.Packet),
+		CallingStation: rfc2865.CallingStationID_GetString(packet.Packet),
+		NASIdentifier:  rfc2865.NASIdentifier_GetString(packet.Packet),
+		NASPort:        uint32(rfc2865.NASPort_Get(packet.Packet)),
+	}
+	if ip := rfc2865.NASIPAddress_Get(packet.Packet); ip != nil {
+		req.NASAddress = ip.String()
+	}
+	if packet.ClientAddr != nil {
+		req.Client = packet.ClientAddr.String()
+	}
+	return req
+}
+
+// key identifies requests with the same decision
+func (r *request) key() string {
+	return strings.Join([]string{r.Mode, r.Code, r.Client, r.UserName, r.CallingStation, r.NASIdentifier, r.NASAddress, strconv.Itoa(int(r.NASPort))}, "/")
+}
+
+// cacheable is true for requests identifying the user or device (replies, e.g. postauth, usually do not)
+func (r *request) cacheable() bool {
+	return len(r.UserName) > 0 || len(r.CallingStation) > 0
+}
+
+// decide asks the endpoint to accept (or reject) a packet
+func (w *webhook) decide(mode string, packet *server.ClientPacket) bool {
+	w.lock.RLock()
+	opts := w.opts
+	client := w.client
+	cache := w.cache
+	disabled := server.Disabled(mode, w.modes)
+	w.lock.RUnlock()
+	if disabled || packet.Packet == nil || client == nil {
+		return true
+	}
+	req := newRequest(mode, packet)
+	key := req.key()
+	now := time.Now()
+	cacheable := req.cacheable()
+	if accept, ok := cache.get(key, now); ok && cacheable {
+		w.results.Inc("cached", w.Name())
+		return accept
+	}
+	resp, err := post(client, opts.URL, req)
+	if err != nil {
+		core.WriteWarn(fmt.Sprintf("webhook failed: %s (%v)", w.Name(), err))
+		w.results.Inc("error", w.Name())
+		return opts.FailOpen
+	}
+	if cacheable {
+		cache.put(key, resp.Accept, now)
+	}
+	if resp.Accept {
+		w.results.Inc("accept", w.Name())
+		return true
+	}
+	w.results.Inc("reject", w.Name())
+	kv := server.KeyValueStore{}
+	kv.DropEmpty = true
+	kv.Add("Result", "REJECT")
+	kv.Add("Mode", mode)
+	kv.Add("User-Name", req.UserName)
+	kv.Add("Calling-Station-Id", req.CallingStation)
+	kv.Add("Id", strconv.Itoa(int(packet.Packet.Identifier)))
+	kv.Add("Message", resp.Message)
+	server.LogPluginMessages(w, kv.Strings())
+	return false
+}
+
+// post sends the request, a decision requires a 200 (OK) response with a JSON body
+func post(client *http.Client, endpoint string, req *request) (*response, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Post(endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", r.Status)
+	}
+	resp := &response{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return resp, nil
+}
+
+func (c *resultCache) get(key string, now time.Time) (bool, bool) {
+	if c.window == 0 {
+		return false, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return false, false
+	}
+	return e.accept, true
+}
+
+// put remembers a decision, dropping expired (or, when still full, all) decisions when the cache is full
+func (c *resultCache) put(key string, accept bool, now time.Time) {
+	if c.window == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			c.entries = make(map[string]*cacheEntry)
+		}
+	}
+	c.entries[key] = &cacheEntry{accept: accept, expires: now.Add(c.window)}
+}
@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/server"
+)
+
+func newTestPlugin(t *testing.T, opts map[string]interface{}) (*webhook, error) {
+	ctx := server.NewPluginContext(&server.Configuration{Dir: os.TempDir()})
+	w := newWebhook()
+	err := w.Setup(ctx.ForPlugin(server.PluginConfig{Name: "webhook", Options: opts}))
+	return w, err
+}
+
+func newPacket(user string) *server.ClientPacket {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1234")
+	p := server.NewClientPacket(nil, addr)
+	p.Packet = radius.New(radius.CodeAccessRequest, []byte("secret"))
+	rfc2865.UserName_AddString(p.Packet, user)
+	rfc2865.CallingStationID_AddString(p.Packet, "aa-bb-cc-dd-ee-ff")
+	rfc2865.NASIdentifier_AddString(p.Packet, "nas")
+	rfc2865.NASIPAddress_Add(p.Packet, net.ParseIP("10.0.0.1"))
+	rfc2865.NASPort_Add(p.Packet, 7)
+	return p
+}
+
+// newTestServer accepts all users except "reject", answers "error" with a failure and "slow" after the timeout
+func newTestServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		req := &request{}
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Code != radius.CodeAccessRequest.String() {
+			json.NewEncoder(w).Encode(&response{Accept: true, Message: req.Code})
+			return
+		}
+		switch req.UserName {
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "slow":
+			time.Sleep(1500 * time.Millisecond)
+		}
+		if req.CallingStation != "aa-bb-cc-dd-ee-ff" || req.NASIdentifier != "nas" || req.NASAddress != "10.0.0.1" || req.NASPort != 7 || req.Client != "127.0.0.1:1234" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&response{Accept: req.UserName != "reject", Message: req.Mode})
+	}))
+}
+
+func TestWebhook(t *testing.T) {
+	var calls int32
+	s := newTestServer(t, &calls)
+	defer s.Close()
+	w, err := newTestPlugin(t, map[string]interface{}{"url": s.URL, "timeout": 1})
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	if w.Name() != "webhook" {
+		t.Error("invalid name")
+	}
+	if !w.Pre(newPacket("user")) || !w.Post(newPacket("user")) {
+		t.Error("should accept")
+	}
+	if w.Pre(newPacket("reject")) || w.Pre(newPacket("reject")) {
+		t.Error("should reject")
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Error("decisions should be cached", calls)
+	}
+	if w.Pre(newPacket("error")) || w.Pre(newPacket("slow")) {
+		t.Error("should fail closed")
+	}
+	if atomic.LoadInt32(&calls) != 5 {
+		t.Error("failures should not be cached", calls)
+	}
+	reply := newPacket("")
+	reply.Packet = reply.Packet.Response(radius.CodeAccessAccept)
+	if !w.Post(reply) || !w.Post(reply) {
+		t.Error("should accept replies")
+	}
+	if atomic.LoadInt32(&calls) != 7 {
+		t.Error("replies without a user or device should not be cached", calls)
+	}
+	w, err = newTestPlugin(t, map[string]interface{}{"url": s.URL, "failopen": true, "cache": -1})
+	if err != nil {
+		t.Fatal("should setup", err)
+	}
+	if !w.Pre(newPacket("error")) {
+		t.Error("should fail open")
+	}
+	atomic.StoreInt32(&calls, 0)
+	w.Pre(newPacket("user"))
+	w.Pre(newPacket("user"))
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Error("decisions should not be cached", calls)
+	}
+}
+
+func TestWebhookOptions(t *testing.T) {
+	for _, opts := range []map[string]interface{}{
+		{},
+		{"url": "/local"},
+		{"url": "ftp://localhost/"},
+		{"url": "http://localhost/", "unknown": true},
+	} {
+		if _, err := newTestPlugin(t, opts); err == nil {
+			t.Error("invalid options", opts)
+		}
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	now := time.Now()
+	c := newResultCache(time.Second, 2)
+	c.put("a", true, now)
+	c.put("b", false, now)
+	if accept, ok := c.get("a", now); !ok || !accept {
+		t.Error("should be cached")
+	}
+	if accept, ok := c.get("b", now); !ok || accept {
+		t.Error("should be cached")
+	}
+	if _, ok := c.get("a", now.Add(time.Second)); ok {
+		t.Error("should expire")
+	}
+	c.put("c", true, now.Add(2*time.Second))
+	if len(c.entries) != 1 {
+		t.Error("expired entries should be dropped", len(c.entries))
+	}
+	c.put("d", true, now.Add(2*time.Second))
+	c.put("e", true, now.Add(2*time.Second))
+	if len(c.entries) != 1 {
+		t.Error("full cache should be reset", len(c.entries))
+	}
+	c = newResultCache(0, 2)
+	c.put("a", true, now)
+	if _, ok := c.get("a", now); ok {
+		t.Error("should not cache")
+	}
+}
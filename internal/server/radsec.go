@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+const (
+	// RadSecSecret is the fixed shared secret for RADIUS over TLS (RFC 6614)
+	RadSecSecret = "radsec"
+)
+
+type (
+	radsecRequest struct {
+		client   [16]byte
+		upstream [16]byte
+	}
+
+	// RadSec relays RADIUS over TLS clients to the (udp) upstream servers
+	RadSec struct {
+		ctx       *Context
+		upstreams *UpstreamPool
+		status    *StatusServer
+		listener  net.Listener
+		idle      time.Duration
+	}
+
+	radsecSession struct {
+		server    *RadSec
+		conn      net.Conn
+		addr      *net.UDPAddr
+		writeLock *sync.Mutex
+		lock      *sync.Mutex
+		sockets   map[*Upstream]*net.UDPConn
+		requests  map[byte]radsecRequest
+		done      chan struct{}
+	}
+)
+
+// NewRadSecTLS creates the (mutual) TLS configuration for RadSec
+func NewRadSecTLS(c *Configuration) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.RadSec.Cert, c.RadSec.Key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(c.RadSec.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", c.RadSec.CA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewRadSec prepares RadSec relaying for clients accepted by the listener (answering Status-Server when given)
+func NewRadSec(ctx *Context, upstreams *UpstreamPool, status *StatusServer, listener net.Listener, idle time.Duration) *RadSec {
+	return &RadSec{ctx: ctx, upstreams: upstreams, status: status, listener: listener, idle: idle}
+}
+
+// ReadRadSecPacket reads a single radius packet from a stream
+func ReadRadSecPacket(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	if length < 20 || length > radius.MaxPacketLength {
+		return nil, fmt.Errorf("invalid packet length: %d", length)
+	}
+	b := make([]byte, length)
+	copy(b, header[:])
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Serve accepts RadSec clients until the listener is closed
+func (r *RadSec) Serve() error {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go r.newSession(conn).run()
+	}
+}
+
+func (r *RadSec) newSession(conn net.Conn) *radsecSession {
+	addr := &net.UDPAddr{}
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		addr = &net.UDPAddr{IP: tcp.IP, Port: tcp.Port, Zone: tcp.Zone}
+	}
+	return &radsecSession{
+		server:    r,
+		conn:      conn,
+		addr:      addr,
+		writeLock: &sync.Mutex{},
+		lock:      &sync.Mutex{},
+		sockets:   make(map[*Upstream]*net.UDPConn),
+		requests:  make(map[byte]radsecRequest),
+		done:      make(chan struct{}),
+	}
+}
+
+func (s *radsecSession) run() {
+	defer s.close()
+	if s.server.ctx.Debug {
+		core.WriteDebug("radsec client connected", s.addr.String())
+	}
+	reader := bufio.NewReader(s.conn)
+	for {
+		if s.server.idle > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.server.idle))
+		}
+		b, err := ReadRadSecPacket(reader)
+		if err != nil {
+			if err != io.EOF {
+				core.WriteError("radsec read failed", err)
+			}
+			return
+		}
+		s.handle(b)
+	}
+}
+
+func (s *radsecSession) close() {
+	close(s.done)
+	s.conn.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.sockets {
+		c.Close()
+	}
+	if s.server.ctx.Debug {
+		core.WriteDebug("radsec client disconnected", s.addr.String())
+	}
+}
+
+func (s *radsecSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// secret is the (udp) secret radsec requests are relayed with
+func (s *radsecSession) secret() []byte {
+	if secret := s.server.ctx.clientSecret(s.addr); secret != nil {
+		return secret
+	}
+	return s.server.ctx.sharedSecret()
+}
+
+func (s *radsecSession) handle(b []byte) {
+	if s.server.status != nil && IsStatusServer(b) {
+		s.server.status.answer(b, []byte(RadSecSecret), s.write)
+		return
+	}
+	secret := s.secret()
+	relayed, err := ResignRequest(b, []byte(RadSecSecret), secret)
+	if err != nil {
+		core.WriteError("unable to relay radsec request", err)
+		return
+	}
+	req := radsecRequest{}
+	copy(req.client[:], b[4:20])
+	copy(req.upstream[:], relayed[4:20])
+	s.lock.Lock()
+	s.requests[b[1]] = req
+	s.lock.Unlock()
+	upstream, relayed := RouteRequest(s.server.ctx, s.server.upstreams, s.addr, relayed, s.reply)
+	if upstream == nil {
+		return
+	}
+	// relayed requests are verified against the secret they were signed with (the shared secret for unmapped peers)
+	relayed, authed := HandleAuth(PreAuthorizeSigned(secret), s.server.ctx, relayed, s.addr, s.reply)
+	if !authed {
+		core.WriteDebug("radsec client failed auth check", "pre")
+		return
+	}
+	socket, err := s.socket(upstream)
+	if err != nil {
+		core.WriteError("dial udp", err)
+		return
+	}
+	if _, err := socket.Write(relayed); err != nil {
+		core.WriteError("unable to write to the server", err)
+		return
+	}
+	s.server.upstreams.Sent(upstream, s.addr, relayed)
+}
+
+func (s *radsecSession) socket(upstream *Upstream) (*net.UDPConn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c, ok := s.sockets[upstream]; ok {
+		return c, nil
+	}
+	c, err := net.DialUDP("udp", nil, upstream.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s.sockets[upstream] = c
+	go s.relay(upstream, c)
+	return c, nil
+}
+
+func (s *radsecSession) relay(upstream *Upstream, c *net.UDPConn) {
+	var buffer [radius.MaxPacketLength]byte
+	for {
+		n, err := c.Read(buffer[0:])
+		if err != nil {
+			if s.closed() {
+				return
+			}
+			core.WriteError("unable to read buffer", err)
+			continue
+		}
+		buffered := append([]byte{}, buffer[0:n]...)
+		request, ok := s.server.upstreams.Responded(upstream, s.addr, buffered)
+		postauth := PostAuthorize
+		if ok {
+			postauth = PostAuthorizeReply(request)
+		}
+		buffered, authed := HandleAuth(postauth, s.server.ctx, buffered, s.addr, s.reply)
+		if !authed {
+			core.WriteDebug("radsec client failed auth check", "post")
+			continue
+		}
+		s.reply(buffered)
+	}
+}
+
+// reply translates a response (from the upstream secret) back to the radsec client
+func (s *radsecSession) reply(b []byte) {
+	if len(b) < 20 {
+		return
+	}
+	s.lock.Lock()
+	req, ok := s.requests[b[1]]
+	s.lock.Unlock()
+	if !ok {
+		core.WriteWarn("radsec response without request", fmt.Sprintf("%d", b[1]))
+		return
+	}
+	resp, err := ResignResponse(b, s.secret(), req.upstream, []byte(RadSecSecret), req.client)
+	if err != nil {
+		core.WriteError("unable to sign radsec response", err)
+		return
+	}
+	s.write(resp)
+}
+
+func (s *radsecSession) write(b []byte) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, err := s.conn.Write(b); err != nil {
+		core.WriteError("radsec write failed", err)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("unable to generate key", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal("unable to create certificate", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	k, _ := x509.MarshalECPrivateKey(c.key)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}), 0600)
+	return certFile, keyFile
+}
+
+func TestReadRadSecPacket(t *testing.T) {
+	p := radius.New(radius.CodeAccessRequest, []byte(RadSecSecret))
+	rfc2865.UserName_SetString(p, "user")
+	b, _ := p.Encode()
+	r := bytes.NewReader(append(append([]byte{}, b...), b...))
+	for i := 0; i < 2; i++ {
+		read, err := ReadRadSecPacket(r)
+		if err != nil || !bytes.Equal(read, b) {
+			t.Error("unable to read packet")
+		}
+	}
+	if _, err := ReadRadSecPacket(r); err == nil {
+		t.Error("no more packets")
+	}
+	if _, err := ReadRadSecPacket(bytes.NewReader([]byte{1, 1, 0, 2})); err == nil || err.Error() != "invalid packet length: 2" {
+		t.Error("invalid length")
+	}
+}
+
+func TestRadSec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "radsec")
+	if err != nil {
+		t.Fatal("unable to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil, 0)
+	caFile, _ := ca.write(t, dir, "ca")
+	c := &Configuration{}
+	c.RadSec.Cert, c.RadSec.Key = newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	c.RadSec.CA = caFile
+	config, err := NewRadSecTLS(c)
+	if err != nil {
+		t.Fatal("invalid tls configuration", err)
+	}
+	c.RadSec.CA = filepath.Join(dir, "server.key")
+	if _, err := NewRadSecTLS(c); err == nil {
+		t.Error("no certificates in ca")
+	}
+
+	secret := []byte("secret")
+	upstream, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer upstream.Close()
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		for {
+			n, addr, err := upstream.ReadFromUDP(buffer[0:])
+			if err != nil {
+				return
+			}
+			req, err := radius.Parse(buffer[0:n], secret)
+			if err != nil || rfc2865.UserPassword_GetString(req) != "password12345678" {
+				continue
+			}
+			b, _ := req.Response(radius.CodeAccessAccept).Encode()
+			upstream.WriteToUDP(b, addr)
+		}
+	}()
+	conf := &Configuration{}
+	conf.Upstreams.Servers = []string{upstream.LocalAddr().String()}
+	conf.Defaults([]byte{})
+	pool, _ := NewUpstreamPool(conf)
+	ctx := &Context{secret: secret}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal("unable to listen", err)
+	}
+	defer listener.Close()
+	go NewRadSec(ctx, pool, NewStatusServer(ctx, false, nil), listener, time.Minute).Serve()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert, clientKey := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth).write(t, dir, "client")
+	pair, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal("unable to connect", err)
+	}
+	defer client.Close()
+	req := radius.New(radius.CodeAccessRequest, []byte(RadSecSecret))
+	rfc2865.UserPassword_SetString(req, "password12345678")
+	b, _ := req.Encode()
+	client.Write(b)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := ReadRadSecPacket(client)
+	if err != nil {
+		t.Fatal("no response", err)
+	}
+	if !radius.IsAuthenticResponse(resp, b, []byte(RadSecSecret)) || radius.Code(resp[0]) != radius.CodeAccessAccept {
+		t.Error("invalid radsec response")
+	}
+	status, _ := newStatusRequest([]byte(RadSecSecret))
+	client.Write(status)
+	resp, err = ReadRadSecPacket(client)
+	if err != nil || radius.Code(resp[0]) != radius.CodeAccessAccept || !radius.IsAuthenticResponse(resp, status, []byte(RadSecSecret)) {
+		t.Error("radsec status server not answered")
+	}
+
+	noCert, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err == nil {
+		noCert.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := noCert.Read(make([]byte, 1)); err == nil {
+			t.Error("client certificate should be required")
+		}
+		noCert.Close()
+	}
+}
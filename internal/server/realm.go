@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+const (
+	// SuffixRealm matches user<delimiter>realm (e.g. user@realm)
+	SuffixRealm = "suffix"
+	// PrefixRealm matches realm<delimiter>user (e.g. realm/user or the authem vlan.user)
+	PrefixRealm = "prefix"
+)
+
+var (
+	realmMetric = newCounter("radiucal_realm_requests_total", "Requests routed by realm", "realm")
+)
+
+type (
+	realmRoute struct {
+		realm Realm
+		pool  *UpstreamPool
+	}
+)
+
+func newRealmRoutes(c *Configuration) ([]*realmRoute, error) {
+	var routes []*realmRoute
+	for _, r := range c.Realms {
+		if len(r.Name) == 0 {
+			return nil, fmt.Errorf("realm name is required")
+		}
+		if r.Match != SuffixRealm && r.Match != PrefixRealm {
+			return nil, fmt.Errorf("unknown realm match for %s: %s", r.Name, r.Match)
+		}
+		route := &realmRoute{realm: r}
+		if !r.Reject {
+			if len(r.Servers) == 0 {
+				return nil, fmt.Errorf("realm %s has no servers", r.Name)
+			}
+			pool, err := newPool(c, r.Servers)
+			if err != nil {
+				return nil, fmt.Errorf("realm %s: %v", r.Name, err)
+			}
+			route.pool = pool
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// user gives the user without the realm when the user name is of the realm
+func (r *realmRoute) user(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	realm := strings.ToLower(r.realm.Name)
+	if r.realm.Match == PrefixRealm {
+		prefix := realm + r.realm.Delimiter
+		if strings.HasPrefix(lower, prefix) {
+			return name[len(prefix):], true
+		}
+		return "", false
+	}
+	suffix := r.realm.Delimiter + realm
+	if strings.HasSuffix(lower, suffix) {
+		return name[0 : len(name)-len(suffix)], true
+	}
+	return "", false
+}
+
+// route finds the realm route of a user name (nil for the default upstreams)
+func (p *UpstreamPool) route(name string) (*realmRoute, string) {
+	if len(name) == 0 {
+		return nil, name
+	}
+	for _, r := range p.realms {
+		if user, ok := r.user(name); ok {
+			return r, user
+		}
+	}
+	return nil, name
+}
+
+// RouteRequest selects the upstream for a request by realm, the request is rewritten when the realm is stripped
+// and answered locally (with no upstream) when the realm is rejected
+func RouteRequest(ctx *Context, p *UpstreamPool, cli *net.UDPAddr, b []byte, write writeBack) (*Upstream, []byte) {
+	if len(p.realms) == 0 {
+		return p.Select(cli, b), b
+	}
+	packet, err := radius.Parse(b, nil)
+	if err != nil {
+		return p.Select(cli, b), b
+	}
+	route, user := p.route(rfc2865.UserName_GetString(packet))
+	if route == nil {
+		return p.Select(cli, b), b
+	}
+	realmMetric.Inc(route.realm.Name)
+	if route.realm.Reject {
+		rejectRealm(ctx, cli, b, write)
+		return nil, nil
+	}
+	if route.realm.Strip {
+		stripped, err := stripRealm(ctx, cli, b, user)
+		if err != nil {
+			core.WriteError("unable to strip realm", err)
+		} else {
+			b = stripped
+		}
+	}
+	return route.pool.Select(cli, b), b
+}
+
+func rejectRealm(ctx *Context, cli *net.UDPAddr, b []byte, write writeBack) {
+	secret := ctx.clientSecret(cli)
+	if secret == nil || write == nil || verifyRequest(b, secret, ctx.requiresAuthenticator()) != nil {
+		return
+	}
+	packet, err := radius.Parse(b, secret)
+	if err != nil || packet.Code != radius.CodeAccessRequest {
+		return
+	}
+	rej, err := EncodePacket(packet.Response(radius.CodeAccessReject))
+	if err != nil {
+		core.WriteError("unable to encode rejection", err)
+		return
+	}
+	core.WriteDebug("rejecting realm")
+	rejectMetric.Inc()
+	write(rej)
+}
+
+func stripRealm(ctx *Context, cli *net.UDPAddr, b []byte, user string) ([]byte, error) {
+	secret := ctx.clientSecret(cli)
+	if secret == nil {
+		return nil, fmt.Errorf("no client secret")
+	}
+	// the request is re-signed so it must be authentic to begin with
+	if err := verifyRequest(b, secret, ctx.requiresAuthenticator()); err != nil {
+		return nil, err
+	}
+	packet, err := radius.Parse(b, secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := rfc2865.UserName_SetString(packet, user); err != nil {
+		return nil, err
+	}
+	return EncodePacket(packet)
+}
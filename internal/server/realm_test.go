@@ -0,0 +1,136 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+func newRealmConfig() *Configuration {
+	c := &Configuration{}
+	c.Upstreams.Servers = []string{"127.0.0.1:1814"}
+	c.Realms = []Realm{
+		{Name: "branch", Servers: []string{"127.0.0.1:1815"}, Strip: true},
+		{Name: "guest", Match: PrefixRealm, Reject: true},
+		{Name: "10", Match: PrefixRealm, Delimiter: ".", Servers: []string{"127.0.0.1:1816"}},
+	}
+	c.Defaults([]byte{})
+	return c
+}
+
+func newRealmRequest(t *testing.T, user string) []byte {
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	rfc2865.UserName_SetString(p, user)
+	rfc2865.UserPassword_SetString(p, "password12345678")
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, err := EncodePacket(p)
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	return b
+}
+
+func TestRealmRoutes(t *testing.T) {
+	c := newRealmConfig()
+	if c.Realms[0].Match != SuffixRealm || c.Realms[0].Delimiter != "@" || c.Realms[1].Delimiter != "/" || c.Realms[2].Delimiter != "." {
+		t.Error("invalid realm defaults")
+	}
+	pool, err := NewUpstreamPool(c)
+	if err != nil || len(pool.pools()) != 3 {
+		t.Fatal("invalid realm pools", err)
+	}
+	for name, expect := range map[string]string{
+		"user@BRANCH":   "user",
+		"guest/user":    "user",
+		"10.user":       "user",
+		"user@other":    "",
+		"user@branch.x": "",
+		"guest":         "",
+		"":              "",
+	} {
+		route, user := pool.route(name)
+		if len(expect) == 0 {
+			if route != nil {
+				t.Error("should not route", name)
+			}
+			continue
+		}
+		if route == nil || user != expect {
+			t.Error("should route", name)
+		}
+	}
+	for _, r := range []Realm{{}, {Name: "x", Match: "any"}, {Name: "x", Match: SuffixRealm}} {
+		c.Realms = []Realm{r}
+		if _, err := NewUpstreamPool(c); err == nil {
+			t.Error("invalid realm", r)
+		}
+	}
+}
+
+func TestRouteRequest(t *testing.T) {
+	ctx := &Context{secret: []byte("secret")}
+	pool, _ := NewUpstreamPool(newRealmConfig())
+	cli := testClient(1)
+	var written [][]byte
+	write := func(b []byte) {
+		written = append(written, b)
+	}
+	b := newRealmRequest(t, "user")
+	u, routed := RouteRequest(ctx, pool, cli, b, write)
+	if u.String() != "127.0.0.1:1814" || &routed[0] != &b[0] {
+		t.Error("default upstreams")
+	}
+	b = newRealmRequest(t, "user@branch")
+	u, routed = RouteRequest(ctx, pool, cli, b, write)
+	if u.String() != "127.0.0.1:1815" {
+		t.Error("realm upstream")
+	}
+	p, _ := radius.Parse(routed, ctx.secret)
+	if rfc2865.UserName_GetString(p) != "user" || rfc2865.UserPassword_GetString(p) != "password12345678" || verifyRequest(routed, ctx.secret, false) != nil {
+		t.Error("realm should be stripped")
+	}
+	b = newRealmRequest(t, "10.user")
+	u, routed = RouteRequest(ctx, pool, cli, b, write)
+	if p, _ := radius.Parse(routed, ctx.secret); u.String() != "127.0.0.1:1816" || rfc2865.UserName_GetString(p) != "10.user" {
+		t.Error("realm should not be stripped")
+	}
+	b = newRealmRequest(t, "guest/user")
+	if u, _ := RouteRequest(ctx, pool, cli, b, write); u != nil || len(written) != 1 {
+		t.Fatal("realm should be rejected")
+	}
+	if radius.Code(written[0][0]) != radius.CodeAccessReject || !radius.IsAuthenticResponse(written[0], b, ctx.secret) {
+		t.Error("invalid realm reject")
+	}
+	ctx.secret = []byte("other")
+	b = newRealmRequest(t, "user@branch")
+	if _, routed := RouteRequest(ctx, pool, cli, b, write); &routed[0] != &b[0] {
+		t.Error("forged requests are not re-signed")
+	}
+}
+
+func TestRealmUpstreamHealth(t *testing.T) {
+	pool, _ := NewUpstreamPool(newRealmConfig())
+	cli := testClient(1)
+	realm := pool.realms[0].pool
+	u := realm.upstreams[0]
+	b := newUpstreamPacket(t, radius.CodeAccessRequest, "", nil)
+	pool.Sent(u, cli, b)
+	if len(realm.pending) != 1 || len(pool.pending) != 0 {
+		t.Error("realm pool should track the request")
+	}
+	pool.Responded(u, cli, b)
+	if len(realm.pending) != 0 {
+		t.Error("realm pool should see the response")
+	}
+	pool.Sent(u, cli, b)
+	for i := 0; i < 3; i++ {
+		pool.Sent(u, testClient(2+i), b)
+	}
+	pool.Check(time.Now().Add(time.Hour))
+	if u.available(time.Now()) {
+		t.Error("realm upstream should be down")
+	}
+}
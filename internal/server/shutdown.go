@@ -0,0 +1,23 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	// drainInterval is how often outstanding requests are checked while draining
+	drainInterval = 50 * time.Millisecond
+)
+
+// Drain waits (up to the timeout) for relayed requests to be answered and accounting to be forwarded,
+// returning the number still outstanding
+func Drain(ctx *Context, upstreams *UpstreamPool, timeout time.Duration) int {
+	end := time.Now().Add(timeout)
+	for {
+		outstanding := upstreams.Pending() + ctx.forwards()
+		if outstanding == 0 || !time.Now().Before(end) {
+			return outstanding
+		}
+		time.Sleep(drainInterval)
+	}
+}
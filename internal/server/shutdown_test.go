@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+func TestDrain(t *testing.T) {
+	ctx := &Context{}
+	if Drain(ctx, nil, time.Second) != 0 {
+		t.Error("nothing to drain")
+	}
+	p := newTestPool(t, FailoverSelect)
+	cli := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	b := newUpstreamPacket(t, radius.CodeAccessRequest, "", nil)
+	u := p.Select(cli, b)
+	p.Sent(u, cli, b)
+	if p.Pending() != 1 {
+		t.Error("should be pending")
+	}
+	if Drain(ctx, p, 10*time.Millisecond) != 1 {
+		t.Error("should still be outstanding")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Responded(u, cli, b)
+	}()
+	if Drain(ctx, p, time.Second) != 0 {
+		t.Error("should be drained")
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	ctx := &Context{}
+	m := &MockModule{}
+	ctx.AddModule(m)
+	ctx.AddModule(&slowModule{})
+	ctx.Teardown()
+	if m.unload != 1 {
+		t.Error("module should be torn down")
+	}
+	m.fail = true
+	ctx.Teardown()
+	if m.unload != 2 {
+		t.Error("module should be torn down on failure")
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"fmt"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc2869"
+)
+
+const (
+	microsoftVendor uint32 = 311
+	msMPPESendKey   byte   = 16
+	msMPPERecvKey   byte   = 17
+)
+
+func zeroAuthenticator(code radius.Code) bool {
+	switch code {
+	case radius.CodeAccountingRequest, radius.CodeDisconnectRequest, radius.CodeCoARequest:
+		return true
+	}
+	return false
+}
+
+// EncodePacket encodes a packet, computing the Message-Authenticator (when present) before the authenticator
+// (responses must carry the request authenticator, e.g. via Response)
+func EncodePacket(p *radius.Packet) ([]byte, error) {
+	var avp *radius.AVP
+	for _, a := range p.Attributes {
+		if a.Type == rfc2869.MessageAuthenticator_Type {
+			avp = a
+			break
+		}
+	}
+	if avp != nil {
+		avp.Attribute = make(radius.Attribute, md5.Size)
+		b, err := p.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if zeroAuthenticator(p.Code) {
+			copy(b[4:20], make([]byte, 16))
+		}
+		hash := hmac.New(md5.New, p.Secret)
+		hash.Write(b)
+		avp.Attribute = hash.Sum(nil)
+	}
+	return p.Encode()
+}
+
+// verifyRequest checks an encoded request against a shared secret using the request authenticator
+// (accounting, CoA, disconnect) or the Message-Authenticator (access, status), access requests without EAP may omit
+// the Message-Authenticator (and then can not be verified) unless it is required
+func verifyRequest(b, secret []byte, required bool) error {
+	if len(b) < 20 || len(secret) == 0 {
+		return fmt.Errorf("invalid request")
+	}
+	code := radius.Code(b[0])
+	if zeroAuthenticator(code) {
+		if !radius.IsAuthenticRequest(b, secret) {
+			return fmt.Errorf("request authenticator mismatch")
+		}
+		return nil
+	}
+	zeroed := append([]byte{}, b...)
+	var given []byte
+	eap := false
+	for attrs := zeroed[20:]; len(attrs) >= 2; {
+		length := int(attrs[1])
+		if length < 2 || length > len(attrs) {
+			return fmt.Errorf("invalid attribute length")
+		}
+		switch attrs[0] {
+		case byte(rfc2869.MessageAuthenticator_Type):
+			given = append([]byte{}, attrs[2:length]...)
+			copy(attrs[2:length], make([]byte, length-2))
+		case byte(rfc2869.EAPMessage_Type):
+			eap = true
+		}
+		attrs = attrs[length:]
+	}
+	if given == nil {
+		// the Message-Authenticator is required for EAP (RFC 3579) and Status-Server (RFC 5997)
+		if eap || required || code == radius.CodeStatusServer {
+			return fmt.Errorf("no message authenticator")
+		}
+		return nil
+	}
+	hash := hmac.New(md5.New, secret)
+	hash.Write(zeroed)
+	if !hmac.Equal(hash.Sum(nil), given) {
+		return fmt.Errorf("message authenticator mismatch")
+	}
+	return nil
+}
+
+// ResignRequest re-encodes an encoded request for a different shared secret
+func ResignRequest(b, from, to []byte) ([]byte, error) {
+	p, err := radius.Parse(b, from)
+	if err != nil {
+		return nil, err
+	}
+	auth := p.Authenticator[:]
+	if err := recrypt(p, from, auth, to, auth); err != nil {
+		return nil, err
+	}
+	p.Secret = to
+	return EncodePacket(p)
+}
+
+// ResignResponse re-encodes an encoded response (to a request with the given authenticator) for
+// a different shared secret and request authenticator
+func ResignResponse(b, from []byte, fromAuth [16]byte, to []byte, toAuth [16]byte) ([]byte, error) {
+	p, err := radius.Parse(b, from)
+	if err != nil {
+		return nil, err
+	}
+	if err := recrypt(p, from, fromAuth[:], to, toAuth[:]); err != nil {
+		return nil, err
+	}
+	p.Secret = to
+	p.Authenticator = toAuth
+	return EncodePacket(p)
+}
+
+// recrypt re-encrypts attributes which are hidden using the shared secret and request authenticator
+func recrypt(p *radius.Packet, from, fromAuth, to, toAuth []byte) error {
+	for _, avp := range p.Attributes {
+		var err error
+		switch avp.Type {
+		case rfc2865.UserPassword_Type:
+			var plain []byte
+			plain, err = radius.UserPassword(avp.Attribute, from, fromAuth)
+			if err == nil {
+				// keep the original (padded) length
+				padded := make([]byte, len(avp.Attribute))
+				copy(padded, plain)
+				avp.Attribute, err = radius.NewUserPassword(padded, to, toAuth)
+			}
+		case rfc2868.TunnelPassword_Type:
+			var tag radius.Attribute
+			value := avp.Attribute
+			if len(value) > 0 && value[0] <= 0x1F {
+				tag = radius.Attribute{value[0]}
+				value = value[1:]
+			}
+			var salted radius.Attribute
+			salted, err = resalt(value, from, fromAuth, to, toAuth)
+			if err == nil {
+				avp.Attribute = append(tag, salted...)
+			}
+		case rfc2865.VendorSpecific_Type:
+			avp.Attribute, err = recryptVendor(avp.Attribute, from, fromAuth, to, toAuth)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to re-encrypt attribute %d (%v)", avp.Type, err)
+		}
+	}
+	return nil
+}
+
+func resalt(a radius.Attribute, from, fromAuth, to, toAuth []byte) (radius.Attribute, error) {
+	plain, salt, err := radius.TunnelPassword(a, from, fromAuth)
+	if err != nil {
+		return nil, err
+	}
+	return radius.NewTunnelPassword(plain, salt, to, toAuth)
+}
+
+func recryptVendor(a radius.Attribute, from, fromAuth, to, toAuth []byte) (radius.Attribute, error) {
+	vendor, vsa, err := radius.VendorSpecific(a)
+	if err != nil || vendor != microsoftVendor {
+		return a, nil
+	}
+	var result radius.Attribute
+	for len(vsa) >= 2 {
+		typ, length := vsa[0], int(vsa[1])
+		if length < 2 || length > len(vsa) {
+			return nil, fmt.Errorf("invalid vendor attribute length")
+		}
+		value := vsa[2:length]
+		if typ == msMPPESendKey || typ == msMPPERecvKey {
+			value, err = resalt(value, from, fromAuth, to, toAuth)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, typ, byte(2+len(value)))
+		result = append(result, value...)
+		vsa = vsa[length:]
+	}
+	return radius.NewVendorSpecific(vendor, result)
+}
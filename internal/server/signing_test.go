@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc2869"
+)
+
+func checkMessageAuthenticator(t *testing.T, b, secret []byte, requestAuth []byte) {
+	p, err := radius.Parse(b, secret)
+	if err != nil {
+		t.Fatal("unable to parse", err)
+	}
+	given := rfc2869.MessageAuthenticator_Get(p)
+	copy(b[4:20], requestAuth)
+	for _, a := range p.Attributes {
+		if a.Type == rfc2869.MessageAuthenticator_Type {
+			a.Attribute = make(radius.Attribute, 16)
+		}
+	}
+	zeroed, _ := p.MarshalBinary()
+	copy(zeroed[4:20], requestAuth)
+	hash := hmac.New(md5.New, secret)
+	hash.Write(zeroed)
+	if !hmac.Equal(hash.Sum(nil), given) {
+		t.Error("invalid message authenticator")
+	}
+}
+
+func TestEncodePacket(t *testing.T) {
+	secret := []byte("secret")
+	p := radius.New(radius.CodeAccessRequest, secret)
+	rfc2865.UserName_SetString(p, "user")
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, err := EncodePacket(p)
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	checkMessageAuthenticator(t, b, secret, p.Authenticator[:])
+	r := p.Response(radius.CodeAccessAccept)
+	rfc2869.MessageAuthenticator_Set(r, make([]byte, 16))
+	resp, err := EncodePacket(r)
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	if !radius.IsAuthenticResponse(resp, b, secret) {
+		t.Error("invalid response authenticator")
+	}
+	checkMessageAuthenticator(t, append([]byte{}, resp...), secret, p.Authenticator[:])
+	a := radius.New(radius.CodeAccountingRequest, secret)
+	rfc2869.MessageAuthenticator_Set(a, make([]byte, 16))
+	acct, _ := EncodePacket(a)
+	if !radius.IsAuthenticRequest(acct, secret) {
+		t.Error("invalid request authenticator")
+	}
+	checkMessageAuthenticator(t, append([]byte{}, acct...), secret, make([]byte, 16))
+}
+
+func TestResignRequest(t *testing.T) {
+	from, to := []byte("radsec"), []byte("secret")
+	p := radius.New(radius.CodeAccessRequest, from)
+	rfc2865.UserPassword_SetString(p, "password12345678")
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, _ := EncodePacket(p)
+	resigned, err := ResignRequest(b, from, to)
+	if err != nil {
+		t.Fatal("unable to resign", err)
+	}
+	if !bytes.Equal(resigned[4:20], b[4:20]) {
+		t.Error("access-request authenticator is unchanged")
+	}
+	r, _ := radius.Parse(resigned, to)
+	if rfc2865.UserPassword_GetString(r) != "password12345678" {
+		t.Error("password not re-encrypted")
+	}
+	checkMessageAuthenticator(t, append([]byte{}, resigned...), to, b[4:20])
+	a := radius.New(radius.CodeAccountingRequest, from)
+	rfc2865.UserName_SetString(a, "user")
+	acct, _ := a.Encode()
+	resigned, err = ResignRequest(acct, from, to)
+	if err != nil || !radius.IsAuthenticRequest(resigned, to) {
+		t.Error("accounting request not resigned")
+	}
+	if _, err := ResignRequest([]byte{1}, from, to); err == nil {
+		t.Error("invalid packet")
+	}
+}
+
+func TestResignResponse(t *testing.T) {
+	from, to := []byte("secret"), []byte("radsec")
+	req := radius.New(radius.CodeAccessRequest, from)
+	var clientAuth [16]byte
+	copy(clientAuth[:], "0123456789abcdef")
+	resp := req.Response(radius.CodeAccessAccept)
+	rfc2868.TunnelPassword_Add(resp, 1, []byte("tunnel"))
+	key := bytes.Repeat([]byte{7}, 32)
+	salted, _ := radius.NewTunnelPassword(key, []byte{0x80, 0x01}, from, req.Authenticator[:])
+	vsa, _ := radius.NewVendorSpecific(microsoftVendor, append([]byte{msMPPESendKey, byte(2 + len(salted))}, salted...))
+	resp.Add(rfc2865.VendorSpecific_Type, vsa)
+	rfc2869.MessageAuthenticator_Set(resp, make([]byte, 16))
+	b, err := EncodePacket(resp)
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	resigned, err := ResignResponse(b, from, req.Authenticator, to, clientAuth)
+	if err != nil {
+		t.Fatal("unable to resign", err)
+	}
+	request := make([]byte, 20)
+	copy(request[4:20], clientAuth[:])
+	if !radius.IsAuthenticResponse(resigned, request, to) {
+		t.Error("invalid response authenticator")
+	}
+	checkMessageAuthenticator(t, append([]byte{}, resigned...), to, clientAuth[:])
+	r, _ := radius.Parse(resigned, to)
+	r.Authenticator = clientAuth
+	if _, pass, err := rfc2868.TunnelPassword_Lookup(r, r); err != nil || string(pass) != "tunnel" {
+		t.Error("tunnel password not re-encrypted")
+	}
+	_, sub, _ := radius.VendorSpecific(r.Get(rfc2865.VendorSpecific_Type))
+	plain, _, err := radius.TunnelPassword(sub[2:], to, clientAuth[:])
+	if err != nil || !bytes.Equal(plain, key) {
+		t.Error("mppe key not re-encrypted")
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("secret")
+	p := radius.New(radius.CodeAccessRequest, secret)
+	rfc2865.UserName_SetString(p, "user")
+	b, _ := p.Encode()
+	if verifyRequest(b, []byte("other"), false) != nil {
+		t.Error("nothing to verify without a message authenticator")
+	}
+	if err := verifyRequest(b, secret, true); err == nil || err.Error() != "no message authenticator" {
+		t.Error("message authenticator is required")
+	}
+	rfc2869.EAPMessage_Set(p, []byte{1})
+	b, _ = p.Encode()
+	if err := verifyRequest(b, secret, false); err == nil || err.Error() != "no message authenticator" {
+		t.Error("eap requires a message authenticator")
+	}
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	b, _ = EncodePacket(p)
+	if verifyRequest(b, secret, false) != nil {
+		t.Error("valid message authenticator")
+	}
+	if err := verifyRequest(b, []byte("other"), false); err == nil || err.Error() != "message authenticator mismatch" {
+		t.Error("invalid message authenticator")
+	}
+	s := radius.New(radius.CodeStatusServer, secret)
+	b, _ = s.Encode()
+	if verifyRequest(b, secret, false) == nil {
+		t.Error("status server requires a message authenticator")
+	}
+	a, _ := radius.New(radius.CodeAccountingRequest, secret).Encode()
+	if verifyRequest(a, secret, false) != nil {
+		t.Error("valid request authenticator")
+	}
+	if err := verifyRequest(a, []byte("other"), false); err == nil || err.Error() != "request authenticator mismatch" {
+		t.Error("invalid request authenticator")
+	}
+	if verifyRequest([]byte{1}, secret, false) == nil || verifyRequest(append(a, 1, 9), secret, false) == nil {
+		t.Error("invalid request")
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+type (
+	// StatusServer answers Status-Server requests (RFC 5997) locally
+	StatusServer struct {
+		ctx       *Context
+		code      radius.Code
+		upstreams *UpstreamPool
+	}
+)
+
+// NewStatusServer answers with an Access-Accept (or Accounting-Response when accounting), when given
+// upstreams the request is only answered while an upstream is healthy
+func NewStatusServer(ctx *Context, accounting bool, upstreams *UpstreamPool) *StatusServer {
+	code := radius.CodeAccessAccept
+	if accounting {
+		code = radius.CodeAccountingResponse
+	}
+	return &StatusServer{ctx: ctx, code: code, upstreams: upstreams}
+}
+
+// IsStatusServer indicates if a packet is a Status-Server request
+func IsStatusServer(b []byte) bool {
+	return len(b) >= 20 && radius.Code(b[0]) == radius.CodeStatusServer
+}
+
+// Handle answers a Status-Server from a client, returning false for any other packet
+func (s *StatusServer) Handle(b []byte, addr *net.UDPAddr, write writeBack) bool {
+	if !IsStatusServer(b) {
+		return false
+	}
+	s.answer(b, s.ctx.clientSecret(addr), write)
+	return true
+}
+
+func (s *StatusServer) answer(b, secret []byte, write writeBack) {
+	receivedMetric.Inc(radius.CodeStatusServer.String())
+	if err := verifyRequest(b, secret, false); err != nil {
+		core.WriteError("invalid status server", err)
+		return
+	}
+	if s.upstreams != nil && !s.upstreams.Healthy() {
+		if s.ctx.Debug {
+			core.WriteDebug("no healthy upstream, status server not answered")
+		}
+		return
+	}
+	resp, err := statusResponse(b, secret, s.code)
+	if err != nil {
+		core.WriteError("unable to answer status server", err)
+		return
+	}
+	write(resp)
+}
+
+// statusResponse builds the (Message-Authenticator signed) response to a Status-Server
+func statusResponse(b, secret []byte, code radius.Code) ([]byte, error) {
+	p, err := radius.Parse(b, secret)
+	if err != nil {
+		return nil, err
+	}
+	resp := p.Response(code)
+	rfc2869.MessageAuthenticator_Set(resp, make([]byte, 16))
+	return EncodePacket(resp)
+}
+
+func newStatusRequest(secret []byte) ([]byte, error) {
+	p := radius.New(radius.CodeStatusServer, secret)
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, 16))
+	return EncodePacket(p)
+}
+
+// probeUpstream sends a Status-Server to an upstream and waits for an authentic response
+func probeUpstream(addr *net.UDPAddr, secret []byte, timeout time.Duration) error {
+	req, err := newStatusRequest(secret)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var buffer [radius.MaxPacketLength]byte
+	for {
+		n, err := conn.Read(buffer[0:])
+		if err != nil {
+			return err
+		}
+		resp := buffer[0:n]
+		if len(resp) < 20 || resp[1] != req[1] {
+			continue
+		}
+		if !radius.IsAuthenticResponse(resp, req, secret) {
+			return fmt.Errorf("response is not authentic")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+func TestStatusServer(t *testing.T) {
+	ctx := &Context{secret: []byte("secret")}
+	s := NewStatusServer(ctx, false, nil)
+	var written [][]byte
+	write := func(b []byte) {
+		written = append(written, b)
+	}
+	req, _ := newStatusRequest(ctx.secret)
+	if !s.Handle(req, nil, write) || len(written) != 1 {
+		t.Fatal("status server not answered")
+	}
+	if radius.Code(written[0][0]) != radius.CodeAccessAccept || !radius.IsAuthenticResponse(written[0], req, ctx.secret) {
+		t.Error("invalid status response")
+	}
+	checkMessageAuthenticator(t, append([]byte{}, written[0]...), ctx.secret, req[4:20])
+	bad, _ := radius.New(radius.CodeStatusServer, ctx.secret).Encode()
+	if !s.Handle(bad, nil, write) || len(written) != 1 {
+		t.Error("status server requires a message authenticator")
+	}
+	other, _ := newStatusRequest([]byte("other"))
+	if !s.Handle(other, nil, write) || len(written) != 1 {
+		t.Error("invalid secret")
+	}
+	access, _ := radius.New(radius.CodeAccessRequest, ctx.secret).Encode()
+	if s.Handle(access, nil, write) {
+		t.Error("not a status server")
+	}
+	acct := NewStatusServer(ctx, true, nil)
+	acct.Handle(req, nil, write)
+	if len(written) != 2 || radius.Code(written[1][0]) != radius.CodeAccountingResponse {
+		t.Error("accounting status response")
+	}
+	pool := newTestPool(t, FailoverSelect)
+	reporting := NewStatusServer(ctx, false, pool)
+	reporting.Handle(req, nil, write)
+	if len(written) != 3 {
+		t.Error("upstreams are healthy")
+	}
+	now := time.Now()
+	for _, u := range pool.upstreams {
+		u.down = now.Add(time.Minute)
+	}
+	reporting.Handle(req, nil, write)
+	if len(written) != 3 {
+		t.Error("upstreams are down")
+	}
+}
+
+func TestProbeUpstreams(t *testing.T) {
+	ctx := &Context{secret: []byte("secret")}
+	upstream, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer upstream.Close()
+	status := NewStatusServer(ctx, false, nil)
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		for {
+			n, addr, err := upstream.ReadFromUDP(buffer[0:])
+			if err != nil {
+				return
+			}
+			status.Handle(append([]byte{}, buffer[0:n]...), addr, func(b []byte) {
+				upstream.WriteToUDP(b, addr)
+			})
+		}
+	}()
+	silent, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer silent.Close()
+	if err := probeUpstream(upstream.LocalAddr().(*net.UDPAddr), ctx.secret, time.Second); err != nil {
+		t.Error("probe should be answered", err)
+	}
+	if err := probeUpstream(silent.LocalAddr().(*net.UDPAddr), ctx.secret, 100*time.Millisecond); err == nil {
+		t.Error("probe should time out")
+	}
+	c := &Configuration{}
+	c.Upstreams.Servers = []string{upstream.LocalAddr().String(), silent.LocalAddr().String()}
+	c.Upstreams.Failures = 1
+	c.Defaults([]byte{})
+	pool, _ := NewUpstreamPool(c)
+	pool.timeout = 100 * time.Millisecond
+	pool.Probe(ctx)
+	now := time.Now()
+	if !pool.upstreams[0].available(now) || pool.upstreams[1].available(now) {
+		t.Error("silent upstream should be down")
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+const (
+	// RunnerCommand is the process started for each supervised instance
+	RunnerCommand = "radiucal-runner"
+)
+
+type (
+	// SupervisorConfiguration lists the runner instances managed by one supervisor
+	SupervisorConfiguration struct {
+		Instances []SupervisedInstance
+		Backoff   struct {
+			Min int
+			Max int
+		}
+		Stable int
+		Stop   int
+		Status string
+	}
+
+	// SupervisedInstance is a runner (configuration) to keep running
+	SupervisedInstance struct {
+		Name   string
+		Config string
+		Debug  bool
+	}
+
+	// InstanceStatus is the state of a supervised instance
+	InstanceStatus struct {
+		Name     string
+		Running  bool
+		PID      int
+		Restarts int
+		Started  time.Time
+		Exited   string
+	}
+
+	// Supervisor starts, monitors, and restarts (with backoff) runner instances
+	Supervisor struct {
+		conf      *SupervisorConfiguration
+		command   string
+		lock      *sync.Mutex
+		instances []*supervised
+		stopping  chan struct{}
+		wait      *sync.WaitGroup
+		metrics   *MetricRegistry
+		restarts  *Counter
+		up        *Gauge
+		jitter    func() float64
+	}
+
+	supervised struct {
+		instance SupervisedInstance
+		status   InstanceStatus
+		process  *os.Process
+	}
+)
+
+// LoadSupervisorConfiguration reads a supervisor configuration (no instances when it is a runner configuration)
+func LoadSupervisorConfiguration(file string) (*SupervisorConfiguration, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	conf := &SupervisorConfiguration{}
+	// a runner configuration shares settings (e.g. status) of other types, only a configuration listing
+	// instances is read as a supervisor configuration
+	probe := struct{ Instances interface{} }{}
+	if err := yaml.Unmarshal(b, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Instances != nil {
+		if err := yaml.Unmarshal(b, conf); err != nil {
+			return nil, err
+		}
+	}
+	conf.Defaults()
+	seen := make(map[string]bool)
+	for _, i := range conf.Instances {
+		if len(i.Name) == 0 || len(i.Config) == 0 {
+			return nil, fmt.Errorf("instances require a name and config")
+		}
+		if seen[i.Name] {
+			return nil, fmt.Errorf("duplicate instance: %s", i.Name)
+		}
+		seen[i.Name] = true
+	}
+	return conf, nil
+}
+
+// Defaults sets the supervisor defaults
+func (c *SupervisorConfiguration) Defaults() {
+	if c.Backoff.Min <= 0 {
+		c.Backoff.Min = 1
+	}
+	if c.Backoff.Max <= 0 {
+		c.Backoff.Max = 60
+	}
+	if c.Backoff.Max < c.Backoff.Min {
+		c.Backoff.Max = c.Backoff.Min
+	}
+	if c.Stable <= 0 {
+		c.Stable = 30
+	}
+	if c.Stop <= 0 {
+		c.Stop = 10
+	}
+}
+
+// NewSupervisor prepares a supervisor to run the configured instances using a (runner) command
+func NewSupervisor(conf *SupervisorConfiguration, command string) *Supervisor {
+	s := &Supervisor{
+		conf:     conf,
+		command:  command,
+		lock:     &sync.Mutex{},
+		stopping: make(chan struct{}),
+		wait:     &sync.WaitGroup{},
+		metrics:  NewMetricRegistry(),
+		jitter:   rand.Float64,
+	}
+	var err error
+	s.restarts, err = s.metrics.NewCounter("radiucal_instance_restarts_total", "Restarts of a supervised instance", "instance")
+	mustMetric(err)
+	s.up, err = s.metrics.NewGauge("radiucal_instance_up", "Whether a supervised instance is running", "instance")
+	mustMetric(err)
+	for _, i := range conf.Instances {
+		s.instances = append(s.instances, &supervised{instance: i, status: InstanceStatus{Name: i.Name}})
+		s.up.Set(0, i.Name)
+	}
+	return s
+}
+
+// Start starts (and monitors) every instance
+func (s *Supervisor) Start() {
+	for _, i := range s.instances {
+		s.wait.Add(1)
+		go s.supervise(i)
+	}
+}
+
+// backoff is the (jittered) delay before restarting after consecutive failures, doubling from min up to max
+func backoff(failures int, min, max time.Duration, jitter float64) time.Duration {
+	delay := min
+	for i := 1; i < failures && delay < max; i++ {
+		delay = delay * 2
+	}
+	if delay > max {
+		delay = max
+	}
+	// between half and the full delay
+	return delay/2 + time.Duration(jitter*float64(delay/2))
+}
+
+func (s *Supervisor) supervise(i *supervised) {
+	defer s.wait.Done()
+	failures := 0
+	args := ProcessFlags{Config: i.instance.Config, Instance: i.instance.Name, Debug: i.instance.Debug}.Args()
+	for {
+		started := time.Now()
+		err := s.run(i, args)
+		if s.stopped() {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		core.WriteWarn(fmt.Sprintf("radiucal runner ended instance: %s (%v)", i.instance.Name, err))
+		if time.Since(started) >= time.Duration(s.conf.Stable)*time.Second {
+			failures = 0
+		}
+		failures++
+		delay := backoff(failures, time.Duration(s.conf.Backoff.Min)*time.Second, time.Duration(s.conf.Backoff.Max)*time.Second, s.jitter())
+		core.WriteInfo(fmt.Sprintf("restarting instance: %s in %s", i.instance.Name, delay))
+		select {
+		case <-s.stopping:
+			return
+		case <-time.After(delay):
+		}
+		s.lock.Lock()
+		i.status.Restarts++
+		s.lock.Unlock()
+		s.restarts.Inc(i.instance.Name)
+	}
+}
+
+func (s *Supervisor) run(i *supervised, args []string) error {
+	cmd := exec.Command(s.command, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	s.lock.Lock()
+	if s.stopped() {
+		s.lock.Unlock()
+		return nil
+	}
+	core.WriteInfo("starting instance: " + i.instance.Name)
+	if err := cmd.Start(); err != nil {
+		i.status.Exited = err.Error()
+		s.lock.Unlock()
+		return err
+	}
+	i.process = cmd.Process
+	i.status.Running = true
+	i.status.PID = cmd.Process.Pid
+	i.status.Started = time.Now()
+	s.lock.Unlock()
+	s.up.Set(1, i.instance.Name)
+	err := cmd.Wait()
+	s.up.Set(0, i.instance.Name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i.process = nil
+	i.status.Running = false
+	i.status.PID = 0
+	i.status.Exited = cmd.ProcessState.String()
+	return err
+}
+
+func (s *Supervisor) stopped() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Signal forwards a signal to every running instance
+func (s *Supervisor) Signal(sig os.Signal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, i := range s.instances {
+		if i.process == nil {
+			continue
+		}
+		if err := i.process.Signal(sig); err != nil {
+			core.WriteError(fmt.Sprintf("unable to signal instance: %s", i.instance.Name), err)
+		}
+	}
+}
+
+// Stop terminates the instances (no restarts), killing those still running after the stop timeout
+func (s *Supervisor) Stop() {
+	s.lock.Lock()
+	if !s.stopped() {
+		close(s.stopping)
+	}
+	s.lock.Unlock()
+	s.Signal(syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		s.wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(time.Duration(s.conf.Stop) * time.Second):
+		core.WriteWarn("instances did not stop, killing")
+		s.Signal(syscall.SIGKILL)
+	}
+	<-done
+}
+
+// Status reports the state of every instance
+func (s *Supervisor) Status() []InstanceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var results []InstanceStatus
+	for _, i := range s.instances {
+		results = append(results, i.status)
+	}
+	return results
+}
+
+// WriteStatus writes the instance status (one instance per line)
+func (s *Supervisor) WriteStatus(w io.Writer) {
+	now := time.Now()
+	for _, i := range s.Status() {
+		state := "stopped"
+		uptime := time.Duration(0)
+		if i.Running {
+			state = "running"
+			uptime = now.Sub(i.Started).Truncate(time.Second)
+		}
+		line := fmt.Sprintf("%s %s pid=%d restarts=%d uptime=%s", i.Name, state, i.PID, i.Restarts, uptime)
+		if len(i.Exited) > 0 {
+			line = fmt.Sprintf("%s exited=%q", line, i.Exited)
+		}
+		io.WriteString(w, line+"\n")
+	}
+}
+
+// ServeHTTP serves the instance status (/status) and supervisor metrics (/metrics)
+func (s *Supervisor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/metrics":
+		s.metrics.ServeHTTP(w, req)
+	case "/status":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		s.WriteStatus(w)
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLoadSupervisorConfiguration(t *testing.T) {
+	if _, err := LoadSupervisorConfiguration("../../tests/nofile"); err == nil {
+		t.Error("no file")
+	}
+	c, err := LoadSupervisorConfiguration("../../tests/test.acct.conf")
+	if err != nil || len(c.Instances) != 0 {
+		t.Error("runner configuration has no instances", err)
+	}
+	if c.Backoff.Min != 1 || c.Backoff.Max != 60 || c.Stable != 30 || c.Stop != 10 || c.Status != "" {
+		t.Error("invalid defaults")
+	}
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal("unable to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "supervisor.conf")
+	ioutil.WriteFile(file, []byte("bind: 1812\nstatus: {upstreams: true, probe: 5}\n"), 0644)
+	c, err = LoadSupervisorConfiguration(file)
+	if err != nil || len(c.Instances) != 0 || c.Status != "" {
+		t.Error("runner configuration with status settings has no instances", err)
+	}
+	ioutil.WriteFile(file, []byte(`
+instances:
+    - name: proxy
+      config: /etc/radiucal/proxy.conf
+    - name: accounting
+      config: /etc/radiucal/accounting.conf
+      debug: true
+backoff:
+    min: 5
+    max: 2
+status: localhost:9813
+`), 0644)
+	c, err = LoadSupervisorConfiguration(file)
+	if err != nil || len(c.Instances) != 2 || c.Instances[1].Name != "accounting" || !c.Instances[1].Debug {
+		t.Fatal("invalid instances", err)
+	}
+	if c.Backoff.Min != 5 || c.Backoff.Max != 5 || c.Status != "localhost:9813" {
+		t.Error("invalid settings")
+	}
+	for _, invalid := range []string{
+		"instances: [{name: proxy}]",
+		"instances: [{name: proxy, config: a}, {name: proxy, config: b}]",
+	} {
+		ioutil.WriteFile(file, []byte(invalid), 0644)
+		if _, err := LoadSupervisorConfiguration(file); err == nil {
+			t.Error("invalid instances", invalid)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	min := time.Second
+	max := 10 * time.Second
+	for failures, expect := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		if d := backoff(failures, min, max, 1); d != expect {
+			t.Error("invalid backoff", failures, d)
+		}
+		if d := backoff(failures, min, max, 0); d != expect/2 {
+			t.Error("invalid jitter", failures, d)
+		}
+	}
+}
+
+func waitFor(t *testing.T, check func() bool, message string) {
+	for i := 0; i < 100; i++ {
+		if check() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal(message)
+}
+
+func TestSupervisor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal("unable to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	signals := filepath.Join(dir, "signals")
+	script := filepath.Join(dir, "runner")
+	// crash unless started for the up instance, which records the reload signal
+	ioutil.WriteFile(script, []byte(`#!/bin/sh
+if [ "$4" != "up" ]; then
+    exit 1
+fi
+trap "echo hup >> `+signals+`" HUP
+while true; do
+    sleep 0.1
+done
+`), 0755)
+	conf := &SupervisorConfiguration{Instances: []SupervisedInstance{{Name: "up", Config: "a"}, {Name: "crash", Config: "b"}}}
+	conf.Defaults()
+	s := NewSupervisor(conf, script)
+	s.jitter = func() float64 {
+		return 0
+	}
+	s.Start()
+	waitFor(t, func() bool {
+		status := s.Status()
+		return status[0].Running && status[0].PID > 0 && status[1].Restarts >= 1
+	}, "instances should be supervised")
+	s.Signal(syscall.SIGHUP)
+	waitFor(t, func() bool {
+		b, _ := ioutil.ReadFile(signals)
+		return strings.TrimSpace(string(b)) == "hup"
+	}, "signal should be forwarded")
+	if s.Status()[0].Restarts != 0 {
+		t.Error("reload should not restart")
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if !strings.HasPrefix(w.Body.String(), "up running pid=") || !strings.Contains(w.Body.String(), "crash stopped pid=0") {
+		t.Error("invalid status", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `radiucal_instance_up{instance="up"} 1`) || !strings.Contains(w.Body.String(), `radiucal_instance_restarts_total{instance="crash"}`) {
+		t.Error("invalid metrics", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 404 {
+		t.Error("unknown path")
+	}
+	s.Stop()
+	for _, i := range s.Status() {
+		if i.Running {
+			t.Error("instance should be stopped", i.Name)
+		}
+	}
+}
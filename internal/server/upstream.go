@@ -0,0 +1,358 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"voidedtech.com/radiucal/internal/core"
+)
+
+const (
+	// FailoverSelect always prefers the first healthy upstream (primary/secondary)
+	FailoverSelect = "failover"
+	// RoundRobinSelect rotates through healthy upstreams
+	RoundRobinSelect = "roundrobin"
+)
+
+type (
+	// Upstream is a backend radius server the proxy relays to
+	Upstream struct {
+		Addr     *net.UDPAddr
+		name     string
+		failures int
+		down     time.Time
+		pool     *UpstreamPool
+	}
+
+	pending struct {
+		upstream      *Upstream
+		sent          time.Time
+		authenticator [16]byte
+	}
+
+	pin struct {
+		upstream *Upstream
+		expires  time.Time
+	}
+
+	// UpstreamPool selects upstreams (with failover/balancing) and tracks their health
+	UpstreamPool struct {
+		lock       *sync.Mutex
+		upstreams  []*Upstream
+		roundRobin bool
+		next       int
+		timeout    time.Duration
+		failures   int
+		holddown   time.Duration
+		pinning    time.Duration
+		pending    map[string]pending
+		pins       map[string]pin
+		realms     []*realmRoute
+	}
+)
+
+// NewUpstream resolves an upstream server address
+func NewUpstream(hostport string) (*Upstream, error) {
+	addr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	return &Upstream{Addr: addr, name: hostport}, nil
+}
+
+// String is the configured name of the upstream
+func (u *Upstream) String() string {
+	return u.name
+}
+
+func (u *Upstream) available(now time.Time) bool {
+	return !now.Before(u.down)
+}
+
+// NewUpstreamPool creates the upstream pool (and realm routes) from configuration
+func NewUpstreamPool(c *Configuration) (*UpstreamPool, error) {
+	pool, err := newPool(c, c.Upstreams.Servers)
+	if err != nil {
+		return nil, err
+	}
+	realms, err := newRealmRoutes(c)
+	if err != nil {
+		return nil, err
+	}
+	pool.realms = realms
+	return pool, nil
+}
+
+func newPool(c *Configuration, servers []string) (*UpstreamPool, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no upstream servers")
+	}
+	var upstreams []*Upstream
+	for _, s := range servers {
+		u, err := NewUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	var roundRobin bool
+	switch c.Upstreams.Mode {
+	case RoundRobinSelect:
+		roundRobin = true
+	case FailoverSelect:
+	default:
+		return nil, fmt.Errorf("unknown upstream mode: %s", c.Upstreams.Mode)
+	}
+	pool := &UpstreamPool{
+		lock:       &sync.Mutex{},
+		upstreams:  upstreams,
+		roundRobin: roundRobin,
+		timeout:    time.Duration(c.Upstreams.Timeout) * time.Second,
+		failures:   c.Upstreams.Failures,
+		holddown:   time.Duration(c.Upstreams.Holddown) * time.Second,
+		pinning:    time.Duration(c.Upstreams.Pin) * time.Second,
+		pending:    make(map[string]pending),
+		pins:       make(map[string]pin),
+	}
+	for _, u := range upstreams {
+		u.pool = pool
+	}
+	return pool, nil
+}
+
+// pools are this pool and those of the realms
+func (p *UpstreamPool) pools() []*UpstreamPool {
+	pools := []*UpstreamPool{p}
+	for _, r := range p.realms {
+		if r.pool != nil {
+			pools = append(pools, r.pool)
+		}
+	}
+	return pools
+}
+
+// owner is the pool an upstream belongs to
+func (p *UpstreamPool) owner(u *Upstream) *UpstreamPool {
+	if u.pool != nil {
+		return u.pool
+	}
+	return p
+}
+
+func stateKey(state []byte) string {
+	return fmt.Sprintf("state:%x", state)
+}
+
+func conversationKeys(cli *net.UDPAddr, p *radius.Packet) []string {
+	var keys []string
+	if p == nil {
+		return keys
+	}
+	if state := rfc2865.State_Get(p); len(state) > 0 {
+		keys = append(keys, stateKey(state))
+	}
+	calling := strings.ToLower(rfc2865.CallingStationID_GetString(p))
+	if cli != nil && len(calling) > 0 {
+		keys = append(keys, fmt.Sprintf("client:%s:%s", cli.String(), calling))
+	}
+	return keys
+}
+
+func pendingKey(cli *net.UDPAddr, identifier byte) string {
+	return fmt.Sprintf("%s:%d", cli.String(), identifier)
+}
+
+// Select picks the upstream for a request, keeping a conversation pinned to the same backend
+func (p *UpstreamPool) Select(cli *net.UDPAddr, b []byte) *Upstream {
+	packet, _ := radius.Parse(b, nil)
+	keys := conversationKeys(cli, packet)
+	now := time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var selected *Upstream
+	for _, k := range keys {
+		if pinned, ok := p.pins[k]; ok && now.Before(pinned.expires) && pinned.upstream.available(now) {
+			selected = pinned.upstream
+			break
+		}
+	}
+	if selected == nil {
+		selected = p.pickLocked(now)
+	}
+	p.pinLocked(keys, selected, now)
+	return selected
+}
+
+func (p *UpstreamPool) pickLocked(now time.Time) *Upstream {
+	count := len(p.upstreams)
+	start := 0
+	if p.roundRobin {
+		start = p.next
+		p.next = (p.next + 1) % count
+	}
+	for i := 0; i < count; i++ {
+		u := p.upstreams[(start+i)%count]
+		if u.available(now) {
+			return u
+		}
+	}
+	// everything is down, keep trying in the configured order
+	return p.upstreams[start]
+}
+
+func (p *UpstreamPool) pinLocked(keys []string, u *Upstream, now time.Time) {
+	if p.pinning <= 0 {
+		return
+	}
+	for _, k := range keys {
+		p.pins[k] = pin{upstream: u, expires: now.Add(p.pinning)}
+	}
+}
+
+// Sent records a request relayed to an upstream, awaiting the response
+func (p *UpstreamPool) Sent(u *Upstream, cli *net.UDPAddr, b []byte) {
+	p.sent(u, cli, b, time.Now())
+}
+
+// sent keeps the time of the first relay of a request (so retransmissions do not hide an upstream timing out)
+func (p *UpstreamPool) sent(u *Upstream, cli *net.UDPAddr, b []byte, now time.Time) {
+	if len(b) < 20 {
+		return
+	}
+	p = p.owner(u)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	sent := pending{upstream: u, sent: now}
+	copy(sent.authenticator[:], b[4:20])
+	key := pendingKey(cli, b[1])
+	if existing, ok := p.pending[key]; ok && existing.upstream == u && existing.authenticator == sent.authenticator {
+		return
+	}
+	p.pending[key] = sent
+}
+
+// Responded records a response from an upstream, marking it healthy, and gives the authenticator of the
+// request it answers (false when the request is no longer pending, e.g. it timed out)
+func (p *UpstreamPool) Responded(u *Upstream, cli *net.UDPAddr, b []byte) ([16]byte, bool) {
+	if len(b) < 20 {
+		return [16]byte{}, false
+	}
+	now := time.Now()
+	packet, _ := radius.Parse(b, nil)
+	p = p.owner(u)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := pendingKey(cli, b[1])
+	sent, ok := p.pending[key]
+	if ok {
+		latencyMetric.Observe(now.Sub(sent.sent).Seconds(), u.String())
+		delete(p.pending, key)
+	}
+	p.respondingLocked(u, now)
+	if packet != nil && packet.Code == radius.CodeAccessChallenge {
+		if state := rfc2865.State_Get(packet); len(state) > 0 {
+			p.pinLocked([]string{stateKey(state)}, u, now)
+		}
+	}
+	return sent.authenticator, ok
+}
+
+// Check expires pending requests (counting timeouts against upstreams) and stale pins
+func (p *UpstreamPool) Check(now time.Time) {
+	for _, pool := range p.pools() {
+		pool.check(now)
+	}
+}
+
+func (p *UpstreamPool) check(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for k, v := range p.pending {
+		if now.Sub(v.sent) < p.timeout {
+			continue
+		}
+		delete(p.pending, k)
+		p.failedLocked(v.upstream, now)
+	}
+	for k, v := range p.pins {
+		if now.After(v.expires) {
+			delete(p.pins, k)
+		}
+	}
+}
+
+func (p *UpstreamPool) respondingLocked(u *Upstream, now time.Time) {
+	if u.failures > 0 || !u.available(now) {
+		core.WriteInfo("upstream is responding", u.String())
+	}
+	u.failures = 0
+	u.down = time.Time{}
+}
+
+func (p *UpstreamPool) failedLocked(u *Upstream, now time.Time) {
+	u.failures++
+	if u.failures < p.failures || !u.available(now) {
+		return
+	}
+	core.WriteWarn("upstream is not responding", u.String())
+	u.down = now.Add(p.holddown)
+}
+
+// Probe sends a Status-Server to each upstream, counting unanswered probes as failures
+func (p *UpstreamPool) Probe(ctx *Context) {
+	secret := ctx.sharedSecret()
+	var wg sync.WaitGroup
+	for _, pool := range p.pools() {
+		for _, u := range pool.upstreams {
+			wg.Add(1)
+			go pool.probe(u, secret, &wg)
+		}
+	}
+	wg.Wait()
+}
+
+func (p *UpstreamPool) probe(u *Upstream, secret []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	err := probeUpstream(u.Addr, secret, p.timeout)
+	now := time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil {
+		core.WriteDebug("upstream probe failed", u.String(), err.Error())
+		p.failedLocked(u, now)
+		return
+	}
+	p.respondingLocked(u, now)
+}
+
+// Pending is the number of relayed requests awaiting a response
+func (p *UpstreamPool) Pending() int {
+	if p == nil {
+		return 0
+	}
+	pending := 0
+	for _, pool := range p.pools() {
+		pool.lock.Lock()
+		pending += len(pool.pending)
+		pool.lock.Unlock()
+	}
+	return pending
+}
+
+// Healthy indicates if any upstream is currently available
+func (p *UpstreamPool) Healthy() bool {
+	now := time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, u := range p.upstreams {
+		if u.available(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func newTestPool(t *testing.T, mode string) *UpstreamPool {
+	c := &Configuration{}
+	c.Upstreams.Servers = []string{"127.0.0.1:1814", "127.0.0.1:1815"}
+	c.Upstreams.Mode = mode
+	c.Defaults([]byte{})
+	p, err := NewUpstreamPool(c)
+	if err != nil {
+		t.Fatal("unable to create pool", err)
+	}
+	return p
+}
+
+func newUpstreamPacket(t *testing.T, code radius.Code, calling string, state []byte) []byte {
+	p := radius.New(code, []byte("secret"))
+	if len(calling) > 0 {
+		rfc2865.CallingStationID_AddString(p, calling)
+	}
+	if state != nil {
+		rfc2865.State_Add(p, state)
+	}
+	b, err := p.Encode()
+	if err != nil {
+		t.Fatal("unable to encode", err)
+	}
+	return b
+}
+
+func TestUpstreamPoolConfig(t *testing.T) {
+	c := &Configuration{}
+	if _, err := NewUpstreamPool(c); err == nil || err.Error() != "no upstream servers" {
+		t.Error("no servers")
+	}
+	c.Defaults([]byte{})
+	c.Upstreams.Mode = "random"
+	if _, err := NewUpstreamPool(c); err == nil || err.Error() != "unknown upstream mode: random" {
+		t.Error("invalid mode")
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	p := newTestPool(t, FailoverSelect)
+	cli := testClient(1000)
+	first := p.Select(cli, nil)
+	if first.String() != "127.0.0.1:1814" {
+		t.Error("should use primary")
+	}
+	if p.Select(cli, nil) != first {
+		t.Error("should stay on primary")
+	}
+	b := newUpstreamPacket(t, radius.CodeAccessRequest, "", nil)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		p.Sent(first, cli, b)
+		p.Check(now.Add(10 * time.Second))
+	}
+	if !p.Healthy() {
+		t.Error("secondary is still up")
+	}
+	second := p.Select(cli, nil)
+	if second == first {
+		t.Error("should failover to secondary")
+	}
+	p.Sent(second, cli, b)
+	p.Check(now.Add(10 * time.Second))
+	p.Sent(second, cli, b)
+	if request, ok := p.Responded(second, cli, b); !ok || !bytes.Equal(request[:], b[4:20]) {
+		t.Error("should give the request authenticator")
+	}
+	p.Check(now.Add(10 * time.Second))
+	if second.failures != 0 {
+		t.Error("responses reset failures")
+	}
+	if _, ok := p.Responded(first, cli, b); ok {
+		t.Error("request is no longer pending")
+	}
+	if p.Select(cli, nil) != first {
+		t.Error("primary should be back")
+	}
+}
+
+func TestUpstreamRetransmissions(t *testing.T) {
+	p := newTestPool(t, FailoverSelect)
+	cli := testClient(1000)
+	first := p.Select(cli, nil)
+	b := newUpstreamPacket(t, radius.CodeAccessRequest, "", nil)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		start := now.Add(time.Duration(i) * 10 * time.Second)
+		p.sent(first, cli, b, start)
+		for _, retry := range []time.Duration{2, 4} {
+			p.sent(first, cli, b, start.Add(retry*time.Second))
+		}
+		p.Check(start.Add(6 * time.Second))
+	}
+	if p.Select(cli, nil) == first {
+		t.Error("retransmissions should not hide timeouts")
+	}
+	other := newUpstreamPacket(t, radius.CodeAccessRequest, "", nil)
+	other[1] = b[1]
+	p.sent(first, cli, b, now)
+	p.sent(first, cli, other, now.Add(4*time.Second))
+	p.Check(now.Add(6 * time.Second))
+	if p.Pending() != 1 {
+		t.Error("a new request (same identifier) restarts the timeout")
+	}
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	p := newTestPool(t, RoundRobinSelect)
+	cli := testClient(1000)
+	a := p.Select(cli, nil)
+	b := p.Select(cli, nil)
+	if a == b {
+		t.Error("should rotate")
+	}
+	if p.Select(cli, nil) != a {
+		t.Error("should wrap around")
+	}
+}
+
+func TestUpstreamPinning(t *testing.T) {
+	p := newTestPool(t, RoundRobinSelect)
+	cli := testClient(1000)
+	req := newUpstreamPacket(t, radius.CodeAccessRequest, "11-22-33-44-55-66", nil)
+	first := p.Select(cli, req)
+	if p.Select(cli, req) != first {
+		t.Error("same client should be pinned")
+	}
+	other := newUpstreamPacket(t, radius.CodeAccessRequest, "11-22-33-44-55-67", nil)
+	if p.Select(cli, other) == first {
+		t.Error("other client should rotate")
+	}
+	state := []byte("conversation")
+	challenge := newUpstreamPacket(t, radius.CodeAccessChallenge, "", state)
+	p.Responded(first, cli, challenge)
+	next := newUpstreamPacket(t, radius.CodeAccessRequest, "", state)
+	if p.Select(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, next) != first {
+		t.Error("state should be pinned")
+	}
+	p.Check(time.Now().Add(2 * time.Minute))
+	if len(p.pins) != 0 {
+		t.Error("pins should expire")
+	}
+}
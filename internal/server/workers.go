@@ -0,0 +1,96 @@
+package server
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+var (
+	saturatedMetric = newCounter("radiucal_saturated_total", "Packets dropped with the worker queue full", "pool")
+)
+
+type (
+	// WorkerPool processes packets on a fixed set of workers, the packets of a client always go to the same
+	// worker (in order) and are dropped when that worker's queue is full
+	WorkerPool struct {
+		name   string
+		lock   *sync.RWMutex
+		closed bool
+		queues []chan func()
+		wait   *sync.WaitGroup
+	}
+)
+
+// NewWorkerPool starts the workers, each with a queue of (at most) depth packets
+func NewWorkerPool(name string, workers, depth int) *WorkerPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if depth < 0 {
+		depth = 0
+	}
+	p := &WorkerPool{name: name, lock: &sync.RWMutex{}, wait: &sync.WaitGroup{}}
+	for i := 0; i < workers; i++ {
+		queue := make(chan func(), depth)
+		p.queues = append(p.queues, queue)
+		p.wait.Add(1)
+		go p.work(queue)
+	}
+	return p
+}
+
+func (p *WorkerPool) work(queue chan func()) {
+	defer p.wait.Done()
+	for fxn := range queue {
+		fxn()
+	}
+}
+
+func (p *WorkerPool) queue(cli *net.UDPAddr) chan func() {
+	if cli == nil || len(p.queues) == 1 {
+		return p.queues[0]
+	}
+	h := fnv.New32a()
+	h.Write(cli.IP)
+	h.Write([]byte{byte(cli.Port >> 8), byte(cli.Port)})
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// Submit queues the processing of a client's packet, returning false when the packet is dropped
+func (p *WorkerPool) Submit(cli *net.UDPAddr, fxn func()) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.queue(cli) <- fxn:
+		return true
+	default:
+		saturatedMetric.Inc(p.name)
+		return false
+	}
+}
+
+// Queued is the number of packets waiting for a worker
+func (p *WorkerPool) Queued() int {
+	queued := 0
+	for _, q := range p.queues {
+		queued += len(q)
+	}
+	return queued
+}
+
+// Close stops accepting packets and waits for the queued packets to be processed
+func (p *WorkerPool) Close() {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.lock.Unlock()
+	p.wait.Wait()
+}
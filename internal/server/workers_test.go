@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerOrdering(t *testing.T) {
+	p := NewWorkerPool("test", 4, 100)
+	lock := &sync.Mutex{}
+	seen := make(map[int][]int)
+	for i := 0; i < 100; i++ {
+		client := i % 10
+		order := i
+		cli := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(client)), Port: 1234}
+		if !p.Submit(cli, func() {
+			lock.Lock()
+			seen[client] = append(seen[client], order)
+			lock.Unlock()
+		}) {
+			t.Error("should be queued")
+		}
+	}
+	p.Close()
+	for client, orders := range seen {
+		if len(orders) != 10 {
+			t.Error("missing packets", client, orders)
+		}
+		for i := 1; i < len(orders); i++ {
+			if orders[i] < orders[i-1] {
+				t.Error("out of order", client, orders)
+			}
+		}
+	}
+}
+
+func TestWorkerSaturation(t *testing.T) {
+	p := NewWorkerPool("test", 1, 1)
+	cli := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	block := make(chan bool)
+	started := make(chan bool)
+	if !p.Submit(cli, func() {
+		started <- true
+		<-block
+	}) {
+		t.Fatal("should be processing")
+	}
+	<-started
+	if !p.Submit(cli, func() {}) {
+		t.Error("should be queued")
+	}
+	if p.Queued() != 1 {
+		t.Error("should have one queued")
+	}
+	if p.Submit(cli, func() {}) {
+		t.Error("should be dropped when saturated")
+	}
+	close(block)
+	p.Close()
+	if p.Queued() != 0 {
+		t.Error("queue should be drained")
+	}
+	if p.Submit(cli, func() {}) {
+		t.Error("closed pool should drop")
+	}
+}
+
+type slowModule struct {
+	delay time.Duration
+}
+
+func (m *slowModule) Name() string {
+	return "slow"
+}
+
+func (m *slowModule) Setup(c *PluginContext) error {
+	return nil
+}
+
+func (m *slowModule) Reload(c *PluginContext) error {
+	return nil
+}
+
+func (m *slowModule) Pre(p *ClientPacket) bool {
+	time.Sleep(m.delay)
+	return true
+}
+
+func benchmarkAuth(b *testing.B, workers int) {
+	ctx, p := getPacket(b)
+	ctx.AddPreAuth(&slowModule{delay: 100 * time.Microsecond})
+	write := func(b []byte) {}
+	var clients []*net.UDPAddr
+	for i := 0; i < 64; i++ {
+		clients = append(clients, &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1234})
+	}
+	pool := NewWorkerPool("bench", workers, 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cli := clients[i%len(clients)]
+		for !pool.Submit(cli, func() {
+			HandleAuth(PreAuthorize, ctx, p.Buffer, cli, write)
+		}) {
+			time.Sleep(time.Microsecond)
+		}
+	}
+	pool.Close()
+}
+
+func BenchmarkSequentialAuth(b *testing.B) {
+	benchmarkAuth(b, 1)
+}
+
+func BenchmarkWorkerPoolAuth(b *testing.B) {
+	benchmarkAuth(b, 8)
+}
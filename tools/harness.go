@@ -42,12 +42,16 @@ func runEndpoint() {
 		panic("unable to listen")
 	}
 	count := 0
+	var buffer [radius.MaxPacketLength]byte
 	for {
-		var buffer []byte
-		_, c, _ := srv.ReadFromUDP(buffer)
+		n, c, _ := srv.ReadFromUDP(buffer[0:])
 		count++
 		ioutil.WriteFile("./bin/count", []byte(fmt.Sprintf("count:%d", count)), 0644)
 		b := newPacket("", "", nil)
+		// answer as the request (identifier) so the proxy sees the request as responded to
+		if n >= 20 {
+			b[1] = buffer[1]
+		}
 		srv.WriteToUDP(b, c)
 	}
 }
@@ -47,7 +47,7 @@ _hostapd() {
 }
 
 _radiucal() {
-    /usr/bin/radiucal --config /etc/radiucal/$1.conf --instance $1 | sed "s/^/[radiucal-$1] /g"
+    /usr/bin/radiucal --config /etc/radiucal/supervisor.conf | sed "s/^/[radiucal] /g"
 }
 
 cwd=$PWD
@@ -75,8 +75,7 @@ while [ 1 -eq 1 ]; do
     fi
     if ! pgrep '^radiucal$' > /dev/null; then
         echo "starting radiucal"
-        _radiucal proxy &
-        _radiucal accounting &
+        _radiucal &
     fi
     sleep 5;
 done
@@ -0,0 +1,67 @@
+#!/usr/bin/python3
+"""
+reference helper for the radiucal exec plugin
+
+reads one JSON request per line on stdin:
+  {"id": 1, "mode": "preauth", "client": "127.0.0.1:1234", "code": "Access-Request", "identifier": 10,
+   "attributes": {"User-Name": ["user"], "Calling-Station-Id": ["AA-BB-CC-DD-EE-FF"]}}
+and writes one JSON response per line on stdout (answering the request with the same id):
+  {"id": 1, "accept": true, "message": "optional text, logged on reject"}
+
+this helper rejects users (or user/mac pairs as user.mac) listed in a deny file (re-read when radiucal reloads and
+restarts the helper), everything else is accepted, log to stderr (stdout is the protocol)
+"""
+import json
+import sys
+
+
+def _load(path):
+    denied = set()
+    try:
+        with open(path) as f:
+            for line in f:
+                line = line.strip()
+                if line and not line.startswith("#"):
+                    denied.add(line.lower())
+    except FileNotFoundError:
+        print("no deny file: {}".format(path), file=sys.stderr)
+    return denied
+
+
+def _first(attributes, name):
+    values = attributes.get(name, [])
+    if len(values) == 0:
+        return ""
+    return values[0].lower()
+
+
+def _decide(denied, request):
+    attributes = request.get("attributes", {})
+    user = _first(attributes, "User-Name")
+    mac = "".join(c for c in _first(attributes, "Calling-Station-Id") if c.isalnum())
+    if user in denied or "{}.{}".format(user, mac) in denied:
+        return False, "denied: {}".format(user)
+    return True, ""
+
+
+def main():
+    path = "/var/lib/radiucal/deny"
+    if len(sys.argv) > 1:
+        path = sys.argv[1]
+    denied = _load(path)
+    for line in sys.stdin:
+        try:
+            request = json.loads(line)
+        except ValueError as e:
+            print("invalid request: {}".format(e), file=sys.stderr)
+            continue
+        accept, message = _decide(denied, request)
+        response = {"id": request.get("id", 0), "accept": accept}
+        if message:
+            response["message"] = message
+        sys.stdout.write(json.dumps(response) + "\n")
+        sys.stdout.flush()
+
+
+if __name__ == "__main__":
+    main()